@@ -0,0 +1,250 @@
+package rethinkgo
+
+// Find the part of a query that the backtrace of a server error points at.
+
+import (
+	"fmt"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var debugCallSites atomic.Bool
+
+// SetDebugCallSites causes the Go file and line where each expression is built
+// to be recorded, so that when the server reports an error in part of a query,
+// the error can say where that part came from, see ErrRuntime.CallSite().
+// Recording call sites makes building queries a lot slower, so this is meant
+// for debugging.
+//
+// Example usage:
+//
+//  r.SetDebugCallSites(true)
+//  err := r.Table("heroes").Map(r.Row.Attr("name").Add(1)).Run(session).Err()
+//  fmt.Println(err)
+//
+// Example output:
+//
+//  rethinkdb: Server could not execute our query: Can only ADD numbers with
+//  numbers and arrays with arrays [mapping body] in Row.Attr("name").Add(Expr(1))
+//  (built at /home/user/heroes.go:12)
+func SetDebugCallSites(enabled bool) {
+	debugCallSites.Store(enabled)
+}
+
+// packagePrefix starts the names of all functions in this package
+var packagePrefix = reflect.TypeOf(Exp{}).PkgPath() + "."
+
+// withCallSite records where an expression was built, if call sites are being
+// recorded
+func withCallSite(e Exp) Exp {
+	if debugCallSites.Load() {
+		e.site = callSite()
+	}
+	return e
+}
+
+// callSite finds the first caller outside of this package
+func callSite() string {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, packagePrefix) || strings.HasSuffix(frame.File, "_test.go") {
+			return fmt.Sprintf("%v:%v", frame.File, frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// errorOrigin is the part of a query that a server error happened in
+type errorOrigin struct {
+	expression string
+	callSite   string
+}
+
+func (o *errorOrigin) getExpression() string {
+	if o == nil {
+		return ""
+	}
+	return o.expression
+}
+
+func (o *errorOrigin) getCallSite() string {
+	if o == nil {
+		return ""
+	}
+	return o.callSite
+}
+
+func (o *errorOrigin) String() string {
+	if o == nil {
+		return ""
+	}
+	if o.callSite == "" {
+		return " in " + o.expression
+	}
+	return fmt.Sprintf(" in %v (built at %v)", o.expression, o.callSite)
+}
+
+// locateError adds the part of the query that failed to an ErrRuntime or
+// ErrBadQuery, if it can be found from the backtrace.  Other errors are
+// returned unchanged.
+func (ctx buildContext) locateError(query Query, err error) error {
+	switch e := err.(type) {
+	case ErrRuntime:
+		e.origin = ctx.findOrigin(query, e.Backtrace())
+		return e
+	case ErrBadQuery:
+		e.origin = ctx.findOrigin(query, e.Backtrace())
+		return e
+	}
+	return err
+}
+
+// findOrigin builds the query again, recording the expression each term comes
+// from, and follows the backtrace frames to the last term that can be found
+func (ctx buildContext) findOrigin(query Query, frames []string) *errorOrigin {
+	if query == nil || len(frames) == 0 {
+		return nil
+	}
+
+	ctx.terms = map[*p.Term]Exp{}
+	queryProto, err := ctx.buildProtobuf(query)
+	if err != nil {
+		return nil
+	}
+
+	// the backtrace of a read query starts at its term, but the backtrace of a
+	// write query starts at the write query itself
+	var node reflect.Value
+	switch {
+	case queryProto.ReadQuery != nil:
+		node = reflect.ValueOf(queryProto.ReadQuery.Term)
+	case queryProto.WriteQuery != nil:
+		node = reflect.ValueOf(queryProto.WriteQuery)
+	default:
+		return nil
+	}
+
+	var origin *errorOrigin
+	for _, frame := range frames {
+		node = followFrame(node, frame)
+		if !node.IsValid() {
+			break
+		}
+		term, ok := node.Interface().(*p.Term)
+		if !ok {
+			continue
+		}
+		e, ok := ctx.terms[term]
+		if !ok {
+			continue
+		}
+		site := e.site
+		if site == "" && origin != nil {
+			// use the nearest enclosing expression that has a call site
+			site = origin.callSite
+		}
+		origin = &errorOrigin{expression: e.String(), callSite: site}
+	}
+	return origin
+}
+
+// frameFields maps the names in backtrace frames to the protocol buffer fields
+// they refer to, where they differ
+var frameFields = map[string]string{
+	"true":       "true_branch",
+	"false":      "false_branch",
+	"modify_map": "mapping",
+}
+
+// indexedFrameFields maps the names in frames with an index, like "arg:1", to
+// the repeated fields they refer to an element of
+var indexedFrameFields = map[string]string{
+	"arg":  "args",
+	"elem": "array",
+	"bind": "binds",
+	"key":  "object",
+	"term": "terms",
+}
+
+// followFrame finds the part of a protocol buffer message that a backtrace
+// frame refers to, returning an invalid value if there is no such part
+func followFrame(node reflect.Value, frame string) reflect.Value {
+	name, index, indexed := strings.Cut(frame, ":")
+	fields := frameFields
+	if indexed {
+		fields = indexedFrameFields
+	}
+	if field, ok := fields[name]; ok {
+		name = field
+	}
+
+	field := findField(node, name)
+	if !field.IsValid() || !indexed {
+		return field
+	}
+
+	if field.Kind() != reflect.Slice {
+		return reflect.Value{}
+	}
+	if i, err := strconv.Atoi(index); err == nil {
+		if i < 0 || i >= field.Len() {
+			return reflect.Value{}
+		}
+		return field.Index(i)
+	}
+	// the variable of a let binding or the key of an object
+	if tuples, ok := field.Interface().([]*p.VarTermTuple); ok {
+		for _, tuple := range tuples {
+			if tuple.GetVar() == index {
+				return reflect.ValueOf(tuple.Term)
+			}
+		}
+	}
+	return reflect.Value{}
+}
+
+var termType = reflect.TypeOf(&p.Term{})
+
+// findField looks for a field with the given protocol buffer name in message,
+// and in the messages it contains, apart from terms, since the server leaves
+// messages like Term.Call and Builtin.Map out of backtraces
+func findField(message reflect.Value, name string) reflect.Value {
+	queue := []reflect.Value{message}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			continue
+		}
+		v = v.Elem()
+
+		for i := 0; i < v.NumField(); i++ {
+			fieldType := v.Type().Field(i)
+			if protobufName(fieldType.Tag) == name {
+				return v.Field(i)
+			}
+			if fieldType.Type.Kind() == reflect.Ptr && fieldType.Type != termType {
+				queue = append(queue, v.Field(i))
+			}
+		}
+	}
+	return reflect.Value{}
+}
+
+// protobufName gets the name of a field from its "protobuf" struct tag
+func protobufName(tag reflect.StructTag) string {
+	for _, option := range strings.Split(tag.Get("protobuf"), ",") {
+		if name, ok := strings.CutPrefix(option, "name="); ok {
+			return name
+		}
+	}
+	return ""
+}
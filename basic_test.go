@@ -4,10 +4,15 @@ package rethinkgo
 // https://github.com/rethinkdb/rethinkdb/blob/next/drivers/javascript/rethinkdb/test.js
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	p "github.com/christopherhesse/rethinkgo/query_language"
 	. "launchpad.net/gocheck"
 	"testing"
+	"time"
 )
 
 // Global expressions used in tests
@@ -864,3 +869,380 @@ func (s *RethinkSuite) TestDropTable(c *C) {
 	err = Db("test").TableDrop("tablex").Run(session).Err()
 	c.Assert(err, IsNil)
 }
+
+func (s *RethinkSuite) TestPipelining(c *C) {
+	sess, err := Connect("localhost:28015", "test")
+	c.Assert(err, IsNil)
+	defer sess.Close()
+	sess.SetPipelining(true)
+	// Connect() leaves a connection in the pool
+	opened := sess.Stats().Open
+
+	// run a bunch of queries at once, including streams that need several
+	// CONTINUE queries, they should all be sent over the same connection
+	results := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			var n int
+			err := Expr(i).Add(1).Run(sess).One(&n)
+			if err == nil && n != i+1 {
+				err = fmt.Errorf("expected %v, got %v", i+1, n)
+			}
+			results <- err
+		}(i)
+		go func() {
+			var rows []interface{}
+			results <- tbl3.Run(sess).Collect(&rows)
+		}()
+	}
+	for i := 0; i < 40; i++ {
+		c.Assert(<-results, IsNil)
+	}
+	c.Assert(sess.sharedConn, NotNil)
+	c.Assert(sess.Stats().Open, Equals, opened+1)
+}
+
+func (s *RethinkSuite) TestRunContext(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := session.RunContext(ctx, Expr(1)).Err()
+	c.Assert(err, Equals, context.Canceled)
+
+	// rows that were already received are still returned after cancelling, but
+	// no more are requested from the server
+	ctx, cancel = context.WithCancel(context.Background())
+	rows := session.RunContext(ctx, tbl)
+	var row interface{}
+	c.Assert(rows.Next(&row), Equals, true)
+	cancel()
+	for rows.Next(&row) {
+	}
+	if rows.status == p.Response_SUCCESS_PARTIAL {
+		c.Assert(rows.Err(), Equals, context.Canceled)
+	}
+	c.Assert(rows.closed, Equals, true)
+
+	var result []interface{}
+	err = tbl.Run(session).CollectContext(context.Background(), &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 10)
+}
+
+func (s *RethinkSuite) TestPool(c *C) {
+	pool := PoolConfig{MaxIdle: 1, MaxOpen: 2, HealthCheck: true}
+	sess, err := ConnectWithPool("localhost:28015", "test", pool)
+	c.Assert(err, IsNil)
+	defer sess.Close()
+
+	// hold on to both connections with open streams, the next query has to wait
+	// for one of them to be released
+	rows1 := Expr(List{1, 2}).ArrayToStream().Run(sess)
+	rows2 := Expr(List{1, 2}).ArrayToStream().Run(sess)
+	stats := sess.Stats()
+	c.Assert(stats.Open <= 2, Equals, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if rows1.conn != nil && rows2.conn != nil {
+		err = sess.RunContext(ctx, Expr(1)).Err()
+		c.Assert(err, Equals, context.DeadlineExceeded)
+		c.Assert(sess.Stats().WaitCount, Equals, int64(1))
+	}
+
+	rows1.Close()
+	rows2.Close()
+	var n int
+	err = Expr(1).Run(sess).One(&n)
+	c.Assert(err, IsNil)
+
+	stats = sess.Stats()
+	c.Assert(stats.InUse, Equals, 0)
+	c.Assert(stats.Idle, Equals, 1)
+	c.Assert(stats.Open, Equals, 1)
+}
+
+func (s *RethinkSuite) TestConnectOpts(c *C) {
+	dials := 0
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	sess, err := ConnectWithOpts(ConnectOpts{
+		Address:     "localhost:28015",
+		Database:    "test",
+		DialTimeout: time.Second,
+		Dial:        dial,
+	})
+	c.Assert(err, IsNil)
+	defer sess.Close()
+	c.Assert(dials, Equals, 1)
+
+	var n int
+	err = Expr(1).Run(sess).One(&n)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// connecting to something that isn't there fails
+	refuse := func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	_, err = ConnectWithOpts(ConnectOpts{DialTimeout: time.Millisecond, Dial: refuse})
+	c.Assert(err, Equals, context.DeadlineExceeded)
+}
+
+func (s *RethinkSuite) TestConnectCluster(c *C) {
+	// find an address that nothing is listening on
+	listener, err := net.Listen("tcp", "localhost:0")
+	c.Assert(err, IsNil)
+	dead := listener.Addr().String()
+	listener.Close()
+
+	sess, err := ConnectCluster([]string{dead, "localhost:28015"}, "test")
+	c.Assert(err, IsNil)
+	defer sess.Close()
+
+	// the dead server is skipped after the first failure
+	for i := 0; i < 5; i++ {
+		var n int
+		err = Expr(i).Run(sess).One(&n)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, i)
+	}
+	c.Assert(sess.hosts.hosts[0].failures, Equals, 1)
+	c.Assert(sess.hosts.hosts[1].failures, Equals, 0)
+}
+
+// closedConn acts as if the server closed the connection after the query was
+// sent
+type closedConn struct {
+	net.Conn
+}
+
+func (conn closedConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *RethinkSuite) TestRetryPolicy(c *C) {
+	dials := 0
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil || dials > 1 {
+			return conn, err
+		}
+		return closedConn{conn}, nil
+	}
+	sess, err := ConnectWithOpts(ConnectOpts{Address: "localhost:28015", Database: "test", Dial: dial})
+	c.Assert(err, IsNil)
+	defer sess.Close()
+	sess.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+
+	var n int
+	err = Expr(1).Run(sess).One(&n)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(dials, Equals, 2)
+
+	c.Assert(retrySafe(Db("test").TableList()), Equals, true)
+	c.Assert(retrySafe(Table("table1").Delete()), Equals, false)
+	c.Assert(retrySafe(Table("table1").Delete().Idempotent(true)), Equals, true)
+
+	c.Assert(RetryPolicy{Jitter: 0.2}.jitter(), Equals, 0.2)
+	c.Assert(RetryPolicy{Jitter: 3}.jitter(), Equals, 1.0)
+	c.Assert(RetryPolicy{Jitter: -1}.jitter(), Equals, 0.0)
+}
+
+type decodePerson struct {
+	Name string `json:"name"`
+	Age  int    `rethinkdb:"years" json:"age"`
+}
+
+type decodeHero struct {
+	decodePerson
+	Power  string `rethinkdb:"superpower,omitempty"`
+	Secret string `rethinkdb:"-"`
+}
+
+type decodePoint struct {
+	X, Y float64
+}
+
+func (pt *decodePoint) DecodeRow(data []byte) error {
+	var xy [2]float64
+	if err := json.Unmarshal(data, &xy); err != nil {
+		return err
+	}
+	pt.X, pt.Y = xy[0], xy[1]
+	return nil
+}
+
+// decodeLevel only implements encoding.TextUnmarshaler
+type decodeLevel int
+
+func (level *decodeLevel) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "level %d", (*int)(level))
+	return err
+}
+
+type decodeServer struct {
+	IP     net.IP      `json:"ip"`
+	Level  decodeLevel `json:"level"`
+	Port   int         `json:"port,string"`
+	Weight *float64    `json:"weight,string"`
+}
+
+func (s *RethinkSuite) TestDecoding(c *C) {
+	var hero decodeHero
+	row := Map{"name": "Superman", "years": 35, "age": 1, "superpower": "flight", "Secret": "Clark"}
+	err := Expr(row).Run(session).One(&hero)
+	c.Assert(err, IsNil)
+	c.Assert(hero.decodePerson, Equals, decodePerson{Name: "Superman", Age: 35})
+	c.Assert(hero.Power, Equals, "flight")
+	c.Assert(hero.Secret, Equals, "")
+
+	var point decodePoint
+	err = Expr(List{1, 2}).Run(session).One(&point)
+	c.Assert(err, IsNil)
+	c.Assert(point, Equals, decodePoint{1, 2})
+
+	err = Expr(Map{"name": 1}).Run(session).One(&hero)
+	c.Assert(err, ErrorMatches, "rethinkdb: Cannot decode number into string at name")
+
+	// rows don't share maps when collected
+	var rows []map[string]int
+	err = Expr(List{Map{"a": 1}, Map{"b": 2}}).ArrayToStream().Run(session).Collect(&rows)
+	c.Assert(err, IsNil)
+	c.Assert(rows, DeepEquals, []map[string]int{{"a": 1}, {"b": 2}})
+
+	session.SetStrictDecoding(true)
+	defer session.SetStrictDecoding(false)
+	err = Expr(Map{"name": "Batman", "age": 40}).Run(session).One(&hero)
+	c.Assert(err, ErrorMatches, `rethinkdb: Unknown attribute "age" in rethinkgo.decodeHero`)
+	session.SetStrictDecoding(false)
+
+	// the same types as encoding/json: text unmarshalers, numbers as map keys
+	// and fields tagged ",string"
+	var server decodeServer
+	row = Map{"ip": "10.0.0.1", "level": "level 3", "port": "28015", "weight": "0.5"}
+	err = Expr(row).Run(session).One(&server)
+	c.Assert(err, IsNil)
+	c.Assert(server.IP.String(), Equals, "10.0.0.1")
+	c.Assert(server.Level, Equals, decodeLevel(3))
+	c.Assert(server.Port, Equals, 28015)
+	c.Assert(*server.Weight, Equals, 0.5)
+
+	err = Expr(Map{"port": "twenty"}).Run(session).One(&server)
+	c.Assert(err, ErrorMatches, `rethinkdb: Cannot decode string "twenty" into int at port`)
+	err = Expr(Map{"level": 3}).Run(session).One(&server)
+	c.Assert(err, ErrorMatches, "rethinkdb: Cannot decode number into rethinkgo.decodeLevel at level")
+
+	var numbers map[int]int
+	err = Expr(Map{"1": 2, "-3": 4}).Run(session).One(&numbers)
+	c.Assert(err, IsNil)
+	c.Assert(numbers, DeepEquals, map[int]int{1: 2, -3: 4})
+	var levels map[decodeLevel][]uint8
+	err = Expr(Map{"level 1": List{1, 2}}).Run(session).One(&levels)
+	c.Assert(err, IsNil)
+	c.Assert(levels, DeepEquals, map[decodeLevel][]uint8{1: {1, 2}})
+	err = Expr(Map{"one": 1}).Run(session).One(&numbers)
+	c.Assert(err, ErrorMatches, `rethinkdb: Cannot decode attribute "one" into int`)
+
+	var anything interface{}
+	err = Expr(Map{"a": List{1, "b", nil, true}}).Run(session).One(&anything)
+	c.Assert(err, IsNil)
+	c.Assert(anything, DeepEquals, map[string]interface{}{"a": []interface{}{1.0, "b", nil, true}})
+}
+
+type encodeHero struct {
+	Id       string `rethinkdb:"id,primarykey"`
+	Name     string `rethinkdb:"name" json:"hero_name"`
+	Nickname string `json:"nickname,omitempty"`
+	Count    int    `rethinkdb:"count"`
+}
+
+// encodes itself with a pointer receiver
+type encodeSecret struct {
+	identity string
+}
+
+func (secret *encodeSecret) MarshalJSON() ([]byte, error) {
+	return json.Marshal("classified")
+}
+
+// encodes itself as a string
+type encodeLevel struct {
+	level int
+}
+
+func (level encodeLevel) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprint("level ", level.level)), nil
+}
+
+type encodeAgent struct {
+	Secret encodeSecret `rethinkdb:"secret"`
+	Level  encodeLevel  `rethinkdb:"level"`
+}
+
+// fields tagged ",string" are sent as strings holding their JSON
+type encodeServer struct {
+	Port   int      `json:"port,string"`
+	Name   string   `json:"name,string"`
+	Weight *float64 `json:"weight,string"`
+}
+
+type encodePatch struct {
+	Count Exp `rethinkdb:"count"`
+	Name  Exp `rethinkdb:"name,omitempty"`
+}
+
+func (s *RethinkSuite) TestEncoding(c *C) {
+	err := Db("test").TableCreate("encoding").Run(session).Err()
+	c.Assert(err, IsNil)
+	defer Db("test").TableDrop("encoding").Run(session)
+	table := Table("encoding")
+
+	var response WriteResponse
+	err = table.Insert(encodeHero{Name: "Superman"}).Run(session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Inserted, Equals, 1)
+	c.Assert(response.GeneratedKeys, HasLen, 1)
+	id := response.GeneratedKeys[0]
+
+	patch := encodePatch{Count: Row.Attr("count").Add(1)}
+	err = table.GetById(id).Update(patch).Run(session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Updated, Equals, 1)
+
+	var row Map
+	err = table.GetById(id).Run(session).One(&row)
+	c.Assert(err, IsNil)
+	c.Assert(row, JsonEquals, Map{"id": id, "name": "Superman", "count": 1})
+
+	var hero encodeHero
+	err = Expr(&encodeHero{Id: "1", Nickname: "Supes"}).Run(session).One(&hero)
+	c.Assert(err, IsNil)
+	c.Assert(hero, Equals, encodeHero{Id: "1", Nickname: "Supes"})
+
+	// structs that encode themselves are encoded the way encoding/json does
+	var agent Map
+	err = Expr(&encodeAgent{Secret: encodeSecret{"Nick Fury"}, Level: encodeLevel{7}}).Run(session).One(&agent)
+	c.Assert(err, IsNil)
+	c.Assert(agent, JsonEquals, Map{"secret": "classified", "level": "level 7"})
+	var level string
+	err = Expr(encodeLevel{3}).Run(session).One(&level)
+	c.Assert(err, IsNil)
+	c.Assert(level, Equals, "level 3")
+
+	var server Map
+	weight := 0.5
+	err = Expr(encodeServer{Port: 28015, Name: "db1", Weight: &weight}).Run(session).One(&server)
+	c.Assert(err, IsNil)
+	c.Assert(server, JsonEquals, Map{"port": "28015", "name": `"db1"`, "weight": "0.5"})
+	var decoded encodeServer
+	err = Expr(encodeServer{Port: 28015, Name: "db1"}).Run(session).One(&decoded)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, Equals, encodeServer{Port: 28015, Name: "db1"})
+}
@@ -0,0 +1,225 @@
+package rethinkgo
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sort"
+	"sync"
+)
+
+// default options for BulkInsert()
+const (
+	defaultBulkBatchSize   = 1000
+	defaultBulkConcurrency = 4
+)
+
+// BulkErrorPolicy says what BulkInsert() does when rows fail to insert, for
+// instance because their primary key already exists.
+type BulkErrorPolicy int
+
+const (
+	// StopOnError stops inserting once a batch reports an error, the batches
+	// that are already running are finished
+	StopOnError BulkErrorPolicy = iota
+	// ContinueOnError inserts all batches, the errors are counted in the
+	// response
+	ContinueOnError
+)
+
+// BulkOpts controls BulkInsert().
+type BulkOpts struct {
+	// BatchSize is the number of rows inserted by each query, zero means 1000
+	BatchSize int
+	// Concurrency is the number of queries running at once, each one uses a
+	// connection from the session's pool, zero means 4
+	Concurrency int
+	// Overwrite replaces existing rows with the same primary key, see
+	// WriteQuery.Overwrite()
+	Overwrite bool
+	// OnError says what to do when rows fail to insert
+	OnError BulkErrorPolicy
+}
+
+// bulkBatch is a batch of rows for BulkInsert(), index is its position among
+// the batches
+type bulkBatch struct {
+	index int
+	rows  []interface{}
+}
+
+type bulkResult struct {
+	index    int
+	response WriteResponse
+	err      error
+}
+
+// BulkInsert inserts all the rows from source into a table, in batches of
+// opts.BatchSize rows that are inserted by up to opts.Concurrency queries at
+// once.  The responses to the queries are added up with WriteResponse.Add(),
+// so GeneratedKeys are in the order of the rows.
+//
+// If a query fails, for instance because of a network error, no more batches
+// are started and the error is returned along with the response for the
+// batches that were inserted.  Rows that fail to insert stop the insert too,
+// returning a WriteError, unless opts.OnError is ContinueOnError.
+//
+// Example usage:
+//
+//  heroes := []Hero{{Name: "Superman"}, {Name: "Batman"}}
+//  response, err := r.BulkInsert(r.Table("heroes"), slices.Values(heroes), session, r.BulkOpts{})
+//
+// Example with a channel:
+//
+//  rows := make(chan r.Map)
+//  go func() {
+//      defer close(rows)
+//      for i := 0; i < 1000000; i++ {
+//          rows <- r.Map{"number": i}
+//      }
+//  }()
+//  opts := r.BulkOpts{BatchSize: 500, Concurrency: 8, OnError: r.ContinueOnError}
+//  response, err := r.BulkInsert(r.Table("numbers"), r.FromChan(rows), session, opts)
+//  fmt.Println("inserted", response.Inserted, "rows with", response.Errors, "errors")
+func BulkInsert[T any](table Exp, source iter.Seq[T], session *Session, opts BulkOpts) (WriteResponse, error) {
+	return BulkInsertContext(context.Background(), table, source, session, opts)
+}
+
+// BulkInsertContext is like BulkInsert, but stops once ctx is done, returning
+// ctx.Err().
+//
+// BulkInsertContext returns without waiting for a source that's blocked, such
+// as a FromChan() channel that's neither closed nor sent to, the source is
+// left to finish in the background.  A goroutine that later sends to the
+// channel stays blocked, since nothing receives from it anymore, so it should
+// watch ctx too.
+func BulkInsertContext[T any](ctx context.Context, table Exp, source iter.Seq[T], session *Session, opts BulkOpts) (WriteResponse, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBulkBatchSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultBulkConcurrency
+	}
+
+	batches := make(chan bulkBatch)
+	results := make(chan bulkResult)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(batches)
+		batch := bulkBatch{}
+		send := func() bool {
+			select {
+			case batches <- batch:
+				batch = bulkBatch{index: batch.index + 1}
+				return true
+			case <-stop:
+			case <-ctx.Done():
+			}
+			return false
+		}
+
+		for row := range source {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			default:
+			}
+			batch.rows = append(batch.rows, row)
+			if len(batch.rows) == opts.BatchSize && !send() {
+				return
+			}
+		}
+		if len(batch.rows) > 0 {
+			send()
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				// don't wait for the source once the insert has stopped, it may be
+				// blocked, the producer finishes in the background
+				var batch bulkBatch
+				var ok bool
+				select {
+				case batch, ok = <-batches:
+				case <-stop:
+				case <-ctx.Done():
+				}
+				if !ok {
+					return
+				}
+
+				query := table.Insert(batch.rows...).Overwrite(opts.Overwrite)
+				response, err := RunWriteContext(ctx, query, session)
+				var writeErr WriteError
+				if errors.As(err, &writeErr) {
+					// the session has strict writes, opts.OnError decides what
+					// happens instead
+					response, err = writeErr.Response, nil
+				}
+				results <- bulkResult{index: batch.index, response: response, err: err}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var done []bulkResult
+	stopped := false
+	for result := range results {
+		done = append(done, result)
+		failed := result.err != nil || (result.response.Errors > 0 && opts.OnError == StopOnError)
+		if failed && !stopped {
+			stopped = true
+			close(stop)
+		}
+	}
+
+	sort.Slice(done, func(i, j int) bool {
+		return done[i].index < done[j].index
+	})
+	var response WriteResponse
+	var err error
+	for _, result := range done {
+		if result.err != nil {
+			if err == nil {
+				err = result.err
+			}
+			continue
+		}
+		response.Add(result.response)
+	}
+
+	switch {
+	case err != nil:
+		return response, err
+	case ctx.Err() != nil:
+		return response, ctx.Err()
+	case opts.OnError == StopOnError:
+		return response, response.Err()
+	}
+	return response, nil
+}
+
+// FromChan returns an iterator over the values received from a channel, until
+// it's closed, for use with BulkInsert().  Once BulkInsert() has stopped, for
+// instance because of an error, nothing receives from the channel, so a sender
+// blocked on it stays blocked.
+func FromChan[T any](ch <-chan T) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for value := range ch {
+			if !yield(value) {
+				return
+			}
+		}
+	}
+}
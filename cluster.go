@@ -0,0 +1,153 @@
+package rethinkgo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// how long to wait before trying a host again after it failed, the wait doubles
+// with each failure in a row up to maxHostBackoff
+const (
+	minHostBackoff = time.Second
+	maxHostBackoff = time.Minute
+)
+
+// host is one of the servers a session connects to.
+type host struct {
+	address string
+
+	// protected by hostList.mutex
+	failures int       // number of failures in a row, 0 if the host is up
+	retryAt  time.Time // when to try the host again if it is down
+}
+
+// hostList spreads new connections across the servers of a session, skipping
+// servers that are down until their backoff has passed.
+type hostList struct {
+	mutex sync.Mutex
+	hosts []*host
+	next  int
+}
+
+func newHostList(addresses []string) *hostList {
+	list := &hostList{}
+	for _, address := range addresses {
+		list.hosts = append(list.hosts, &host{address: address})
+	}
+	return list
+}
+
+// candidates returns the hosts to try for a new connection, in order.  Hosts
+// that are up, or whose backoff has passed, come first in round-robin order,
+// followed by hosts that are still down, soonest retry first, so that we try
+// everything before giving up.
+func (list *hostList) candidates() []*host {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	now := time.Now()
+	var up, down []*host
+	n := len(list.hosts)
+	for i := 0; i < n; i++ {
+		h := list.hosts[(list.next+i)%n]
+		if h.failures == 0 || !now.Before(h.retryAt) {
+			up = append(up, h)
+		} else {
+			down = append(down, h)
+		}
+	}
+	if n > 0 {
+		list.next = (list.next + 1) % n
+	}
+
+	// insertion sort, there won't be many hosts
+	for i := 1; i < len(down); i++ {
+		for j := i; j > 0 && down[j].retryAt.Before(down[j-1].retryAt); j-- {
+			down[j], down[j-1] = down[j-1], down[j]
+		}
+	}
+	return append(up, down...)
+}
+
+// markDown records a failed connection or network error for a host.
+func (list *hostList) markDown(h *host) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	backoff := minHostBackoff << uint(h.failures)
+	if backoff > maxHostBackoff || backoff <= 0 {
+		backoff = maxHostBackoff
+	}
+	h.failures++
+	h.retryAt = time.Now().Add(backoff)
+}
+
+// markUp records a successful connection to a host.
+func (list *hostList) markUp(h *host) {
+	list.mutex.Lock()
+	h.failures = 0
+	list.mutex.Unlock()
+}
+
+// ConnectCluster creates a new database session that connects to several
+// servers of a RethinkDB cluster.  New connections are spread across the
+// servers in turn.  A server that can't be reached, or whose connection fails
+// with a network error, is skipped for a while, then tried again, waiting
+// longer after each failure in a row.  If connecting to one server fails, the
+// query is sent to the next one instead.
+//
+// Example usage:
+//
+//  addresses := []string{"db1:28015", "db2:28015", "db3:28015"}
+//  sess, err := r.ConnectCluster(addresses, "test")
+func ConnectCluster(addresses []string, database string) (*Session, error) {
+	return ConnectWithOpts(ConnectOpts{Addresses: addresses, Database: database})
+}
+
+// dial connects to one of the session's servers, trying each of them until one
+// works.
+func (s *Session) dial(ctx context.Context) (*connection, error) {
+	candidates := s.hosts.candidates()
+	if len(candidates) == 0 {
+		return nil, errors.New("rethinkdb: No server address given")
+	}
+
+	var lastErr error
+	for _, h := range candidates {
+		conn, err := serverConnect(ctx, h.address, s.opts)
+		if err == nil {
+			s.hosts.markUp(h)
+			conn.host = h
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			// our fault, not the server's
+			return nil, err
+		}
+		s.hosts.markDown(h)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// hostFailed marks the server a connection was made to as down if err is a
+// network error, so new connections go to other servers for a while.
+func (s *Session) hostFailed(conn *connection, err error) {
+	if conn.host != nil && isNetworkError(err) {
+		s.hosts.markDown(conn.host)
+	}
+}
+
+// isNetworkError returns true if err was caused by the connection to the server
+// failing, as opposed to an error reported by the server or a timeout.
+func isNetworkError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && !netErr.Timeout()
+}
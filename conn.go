@@ -2,36 +2,140 @@ package rethinkgo
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	p "github.com/christopherhesse/rethinkgo/query_language"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
-// connection is a connection to a rethinkdb database, it is not shared between
-// goroutines.
+// connection is a connection to a rethinkdb database.  A regular connection is
+// not shared between goroutines, it serves one query at a time.  A multiplexed
+// connection (see startReader()) can have many queries in flight at once, a
+// reader goroutine matches each response to the waiting query by its token.
 type connection struct {
 	// embed the net.Conn type, so that we can effectively define new methods on
 	// it (interfaces do not allow that)
 	net.Conn
+
+	// the server this connection is to, see cluster.go
+	host *host
+
+	// used by the session's connection pool, see pool.go
+	createdAt  time.Time
+	idleSince  time.Time
+	idle       bool
+	poolClosed bool
+
+	// told about the size of each message, see metrics.go
+	collector Collector
+
+	// the remaining fields are only used by multiplexed connections
+
+	multiplexed bool
+	// serializes writes so that messages from different queries are not
+	// interleaved on the wire
+	writeMutex sync.Mutex
+	// protects waiters, err and refs
+	mutex sync.Mutex
+	// queries waiting for a response, keyed by token
+	waiters map[int64]chan *p.Response
+	// set once the reader goroutine has stopped, the connection is unusable
+	// after that
+	err error
+	// number of Run() calls and open Rows iterators using this connection
+	refs int
 }
 
+// timeoutError is returned when a query on a multiplexed connection takes
+// longer than the session timeout.  Like the errors returned when a deadline
+// expires on a regular connection, it satisfies net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "rethinkdb: Query timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 var debugMode bool = false
 
 const clientHello uint32 = 0xaf61ba35
 
-func serverConnect(address string) (*connection, error) {
-	conn, err := net.Dial("tcp", address)
+// aLongTimeAgo is a deadline in the past, setting it on a connection aborts
+// any read or write in progress.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// serverConnect opens a new connection to the server as specified by opts and
+// introduces us to the server.
+func serverConnect(ctx context.Context, address string, opts ConnectOpts) (*connection, error) {
+	if opts.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.DialTimeout)
+		defer cancel()
+	}
+
+	conn, err := dial(ctx, address, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	// the dial is covered by ctx, make sure the hello is too
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
 	if err := binary.Write(conn, binary.LittleEndian, clientHello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &connection{Conn: conn, createdAt: time.Now(), collector: opts.Collector}, nil
+}
+
+// dial opens the network connection for serverConnect().
+func dial(ctx context.Context, address string, opts ConnectOpts) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if opts.Dial != nil {
+		conn, err = opts.Dial(ctx, "tcp", address)
+	} else {
+		dialer := net.Dialer{KeepAlive: opts.KeepAlive}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil || opts.TLSConfig == nil {
+		return conn, err
+	}
+
+	config := opts.TLSConfig
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return &connection{conn}, nil
+	return tlsConn, nil
+}
+
+// abandoned returns true if executeQuery() gave up waiting for the server
+// because of err.  The response may still arrive later, so a regular
+// connection is in an unknown state and should not be used again.
+func abandoned(ctx context.Context, err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return err != nil && err == ctx.Err()
 }
 
 // SetDebug causes all queries sent to the server and responses received to be
@@ -40,6 +144,9 @@ func serverConnect(address string) (*connection, error) {
 // Example usage:
 //
 //  r.SetDebug(true)
+//
+// Deprecated: Use Session.SetQueryHook(), for instance with SlogHook(), to
+// log the queries of a session.
 func SetDebug(debug bool) {
 	debugMode = debug
 }
@@ -53,6 +160,9 @@ func (c *connection) writeMessage(data []byte) error {
 	}
 
 	_, err := c.Write(data)
+	if err == nil && c.collector != nil {
+		c.collector.MessageSent(4 + len(data))
+	}
 	return err
 }
 
@@ -71,6 +181,11 @@ func (c *connection) writeQuery(protobuf *p.Query) error {
 func (c *connection) readMessage() ([]byte, error) {
 	var messageLength uint32
 	if err := binary.Read(c, binary.LittleEndian, &messageLength); err != nil {
+		if err == io.EOF {
+			// the server closed the connection, io.EOF would be mistaken for the
+			// normal end of a Rows iterator
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
 
@@ -78,6 +193,9 @@ func (c *connection) readMessage() ([]byte, error) {
 	buf := make([]byte, messageLength)
 	for {
 		n, err := c.Read(buf[0:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -86,9 +204,154 @@ func (c *connection) readMessage() ([]byte, error) {
 			break
 		}
 	}
+	if c.collector != nil {
+		c.collector.MessageReceived(4 + len(result))
+	}
 	return result, nil
 }
 
+// startReader turns this connection into a multiplexed connection, starting a
+// goroutine that reads every response from the server and hands it to the
+// query waiting on the same token.
+func (c *connection) startReader() {
+	c.multiplexed = true
+	c.waiters = map[int64]chan *p.Response{}
+	go c.readLoop()
+}
+
+func (c *connection) readLoop() {
+	for {
+		response, err := c.readResponse()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		token := response.GetToken()
+		c.mutex.Lock()
+		waiter, ok := c.waiters[token]
+		delete(c.waiters, token)
+		c.mutex.Unlock()
+
+		if ok {
+			waiter <- response
+		} else if response.GetStatusCode() == p.Response_SUCCESS_PARTIAL {
+			// nobody is waiting for this any more (the query probably timed out),
+			// but the server is holding a stream open for it, tell the server to
+			// discard the stream.  The response to the STOP is dropped as well.
+			go c.send(&p.Query{
+				Type:  p.Query_STOP.Enum(),
+				Token: proto.Int64(token),
+			})
+		}
+	}
+}
+
+// fail marks a multiplexed connection as broken, wakes up any queries waiting
+// on it and closes the underlying network connection.
+func (c *connection) fail(err error) {
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = err
+		for token, waiter := range c.waiters {
+			close(waiter)
+			delete(c.waiters, token)
+		}
+	}
+	c.mutex.Unlock()
+
+	c.Conn.Close()
+}
+
+// broken returns the error that caused a multiplexed connection to stop
+// working, or nil if it is still usable.
+func (c *connection) broken() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// users returns the number of queries and iterators using a multiplexed
+// connection.
+func (c *connection) users() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.refs
+}
+
+// alive checks that an idle connection has not been closed by the server or the
+// network.  The server never sends anything on an idle connection, so a read
+// that doesn't time out right away means the connection is closed (or
+// confused).  The deadline has to be in the future, otherwise the read is not
+// even attempted.
+func (c *connection) alive() bool {
+	c.SetReadDeadline(time.Now().Add(100 * time.Microsecond))
+	var buf [1]byte
+	_, err := c.Read(buf[:])
+	c.SetReadDeadline(time.Time{})
+
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// send writes a single query to a multiplexed connection.
+func (c *connection) send(protobuf *p.Query) error {
+	c.writeMutex.Lock()
+	err := c.writeQuery(protobuf)
+	c.writeMutex.Unlock()
+
+	if err != nil {
+		// we may have written part of a message, nothing sent after this would
+		// make sense to the server
+		c.fail(err)
+	}
+	return err
+}
+
+// roundTrip sends a query over a multiplexed connection and waits for the
+// reader goroutine to hand over the matching response.
+func (c *connection) roundTrip(ctx context.Context, protobuf *p.Query, timeout time.Duration) (*p.Response, error) {
+	token := protobuf.GetToken()
+	waiter := make(chan *p.Response, 1)
+
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	c.waiters[token] = waiter
+	c.mutex.Unlock()
+
+	if err := c.send(protobuf); err != nil {
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case response, ok := <-waiter:
+		if !ok {
+			return nil, c.broken()
+		}
+		return response, nil
+	case <-expired:
+		err = timeoutError{}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.mutex.Lock()
+	delete(c.waiters, token)
+	c.mutex.Unlock()
+	return nil, err
+}
+
 // readResponse reads a protobuf message from a connection and parses it.
 func (c *connection) readResponse() (*p.Response, error) {
 	data, err := c.readMessage()
@@ -122,28 +385,71 @@ func (c *connection) executeQueryProtobuf(protobuf *p.Query) (responseProto *p.R
 	return
 }
 
+// executeQueryDeadline runs executeQueryProtobuf() on a regular connection,
+// using the connection deadline to enforce both the timeout and ctx.
+func (c *connection) executeQueryDeadline(ctx context.Context, protobuf *p.Query, timeout time.Duration) (*p.Response, error) {
+	// if the user has set a timeout, make sure we set a deadline on the
+	// connection so that we don't exceed the timeout.  if not, use the zero
+	// time value to indicate no deadline
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	ctxDeadline, fromCtx := ctx.Deadline()
+	if fromCtx && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	} else {
+		fromCtx = false
+	}
+	c.SetDeadline(deadline)
+
+	// if ctx is cancelled, abort the network wait by moving the deadline into
+	// the past
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+		close(cancelled)
+	})
+
+	r, err := c.executeQueryProtobuf(protobuf)
+
+	if !stop() {
+		// wait for the deadline to have been moved, so that we don't reset it
+		// before that happens
+		<-cancelled
+	}
+	// reset the deadline for the connection
+	c.SetDeadline(time.Time{})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() && fromCtx {
+			// the deadline from ctx expired before ctx noticed
+			err = context.DeadlineExceeded
+		}
+	}
+	return r, err
+}
+
 // executeQuery is an internal function, shared by Rows iterator and the normal
 // Run() call. Runs a protocol buffer formatted query, returns a list of strings
-// and a status code.
-func (c *connection) executeQuery(queryProto *p.Query, timeout time.Duration) (result []string, status p.Response_StatusCode, err error) {
+// and a status code.  If ctx is done before the response arrives, ctx.Err() is
+// returned.
+func (c *connection) executeQuery(ctx context.Context, queryProto *p.Query, timeout time.Duration) (result []string, status p.Response_StatusCode, err error) {
 	if debugMode {
 		fmt.Printf("rethinkdb: queryProto:\n%v", protobufToString(queryProto, 1))
 	}
 
-	// if the user has set a timeout, make sure we set a deadline on the connection
-	// so that we don't exceed the timeout.  if not, use the zero time value to
-	// indicate no deadline
-	if timeout == 0 {
-		c.SetDeadline(time.Time{})
+	var r *p.Response
+	if c.multiplexed {
+		// other queries are using this connection, so we can't set a deadline on
+		// it, roundTrip() enforces the timeout instead
+		r, err = c.roundTrip(ctx, queryProto, timeout)
 	} else {
-		c.SetDeadline(time.Now().Add(timeout))
+		r, err = c.executeQueryDeadline(ctx, queryProto, timeout)
 	}
 
-	r, err := c.executeQueryProtobuf(queryProto)
-
-	// reset the deadline for the connection
-	c.SetDeadline(time.Time{})
-
 	if err != nil {
 		return
 	}
@@ -0,0 +1,759 @@
+package rethinkgo
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// RowDecoder is implemented by types that decode rows themselves instead of
+// having the driver fill in their fields.  data is the JSON document for a
+// single row, or for the part of a row being decoded into the type, it belongs
+// to DecodeRow, which can keep it.
+//
+// Example usage:
+//
+//  type Point struct {
+//      X, Y float64
+//  }
+//
+//  // decode rows stored as [x, y]
+//  func (p *Point) DecodeRow(data []byte) error {
+//      var xy [2]float64
+//      if err := json.Unmarshal(data, &xy); err != nil {
+//          return err
+//      }
+//      p.X, p.Y = xy[0], xy[1]
+//      return nil
+//  }
+type RowDecoder interface {
+	DecodeRow(data []byte) error
+}
+
+// SetStrictDecoding causes rows decoded into structs to fail with an error if
+// they have an attribute that doesn't match any field of the struct, instead of
+// ignoring it.  This catches typos in field names and documents that don't have
+// the expected shape.
+//
+// Example usage:
+//
+//  sess.SetStrictDecoding(true)
+func (s *Session) SetStrictDecoding(strict bool) {
+	s.strictDecoding = strict
+}
+
+// DecodeFunc decodes the JSON document for a row into dest, see
+// Session.SetDecodeFunc().  data belongs to the function, which can keep it.
+type DecodeFunc func(data []byte, dest interface{}) error
+
+// SetDecodeFunc replaces the driver's decoding of rows with decode, for
+// instance to use a faster JSON library.  Struct tags and strict decoding are
+// then up to decode.  Use nil to go back to the driver's decoding.
+//
+// Example usage:
+//
+//  sess.SetDecodeFunc(jsoniter.Unmarshal)
+func (s *Session) SetDecodeFunc(decode DecodeFunc) {
+	s.decodeFunc = decode
+}
+
+// decode decodes a row using the session's settings, s may be nil.  data may
+// come from stringBytes(), so it's copied before it's passed to code outside
+// the driver, which could keep or modify it.
+func (s *Session) decode(data []byte, dest interface{}) error {
+	if s == nil {
+		return decodeRow(data, dest, false)
+	}
+	if s.decodeFunc != nil {
+		return s.decodeFunc(bytes.Clone(data), dest)
+	}
+	return decodeRow(data, dest, s.strictDecoding)
+}
+
+// stringBytes returns the bytes of a string without copying them, so they
+// must not be modified or kept, which means they can only be passed to the
+// driver's own decoding
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+var (
+	rowDecoderType      = reflect.TypeOf((*RowDecoder)(nil)).Elem()
+	unmarshalerType     = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	numberType          = reflect.TypeOf(json.Number(""))
+)
+
+// decodeRow decodes a JSON row into dest, which must be a pointer.
+//
+// Struct fields are matched with the attributes of a row by name, using the
+// name in the field's `rethinkdb` tag if it has one, then the name in its
+// `json` tag, then the name of the field.  As with encoding/json, names are
+// matched case-insensitively if there is no exact match, the fields of
+// embedded structs are treated as fields of the outer struct, a field tagged
+// ",string" is decoded from a string holding its JSON, and types that implement
+// encoding.TextUnmarshaler are decoded from strings, also as map keys.
+//
+//  type Hero struct {
+//      Person               // fields of Person are decoded as well
+//      Name   string `rethinkdb:"hero_name" json:"name"`
+//      Secret string `rethinkdb:"-"`
+//  }
+//
+// The row is decoded straight from data, which isn't kept.
+func decodeRow(data []byte, dest interface{}, strict bool) error {
+	switch d := dest.(type) {
+	case RowDecoder:
+		return d.DecodeRow(bytes.Clone(data))
+	case json.Unmarshaler:
+		return d.UnmarshalJSON(bytes.Clone(data))
+	}
+
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("rethinkdb: `dest` must be a non-nil pointer")
+	}
+
+	d := rowDecoder{scanner: scanner{data: data}, strict: strict}
+	if err := d.value(v.Elem()); err != nil {
+		return err
+	}
+	if d.peek() != 0 {
+		return d.syntaxError("unexpected data after the row")
+	}
+	return nil
+}
+
+// rowDecoder decodes the values of a row as the scanner reads them
+type rowDecoder struct {
+	scanner
+	strict bool
+}
+
+// decodeError is an error decoding part of a row, its path is filled in as it's
+// returned through the values that contain that part
+type decodeError struct {
+	message string
+	path    string
+}
+
+func (e *decodeError) Error() string {
+	if e.path == "" {
+		return "rethinkdb: " + e.message
+	}
+	return "rethinkdb: " + e.message + " at " + strings.TrimPrefix(e.path, ".")
+}
+
+// atKey adds an attribute name to the path of a decodeError
+func atKey(err error, key []byte) error {
+	if e, ok := err.(*decodeError); ok {
+		e.path = "." + string(key) + e.path
+	}
+	return err
+}
+
+// atIndex adds an array index to the path of a decodeError
+func atIndex(err error, i int) error {
+	if e, ok := err.(*decodeError); ok {
+		e.path = "[" + strconv.Itoa(i) + "]" + e.path
+	}
+	return err
+}
+
+func typeError(jsonType string, t reflect.Type) error {
+	return &decodeError{message: fmt.Sprintf("Cannot decode %v into %v", jsonType, t)}
+}
+
+// jsonTypeName names the type of a JSON value from its first byte
+func jsonTypeName(c byte) string {
+	switch c {
+	case 'n':
+		return "null"
+	case 't', 'f':
+		return "boolean"
+	case '"':
+		return "string"
+	case '[':
+		return "array"
+	case '{':
+		return "object"
+	}
+	return "number"
+}
+
+// value decodes the next value of the row into v
+func (d *rowDecoder) value(v reflect.Value) error {
+	c := d.peek()
+
+	// let types decode themselves
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		if pointer := v.Addr(); pointer.NumMethod() > 0 {
+			pointerType := pointer.Type()
+			switch {
+			case pointerType.Implements(rowDecoderType):
+				data, err := d.raw()
+				if err != nil {
+					return err
+				}
+				return pointer.Interface().(RowDecoder).DecodeRow(data)
+			case pointerType.Implements(unmarshalerType):
+				data, err := d.raw()
+				if err != nil {
+					return err
+				}
+				return pointer.Interface().(json.Unmarshaler).UnmarshalJSON(data)
+			case c != 'n' && pointerType.Implements(textUnmarshalerType):
+				if c != '"' {
+					return typeError(jsonTypeName(c), v.Type())
+				}
+				text, err := d.str()
+				if err != nil {
+					return err
+				}
+				return pointer.Interface().(encoding.TextUnmarshaler).UnmarshalText(bytes.Clone(text))
+			}
+		}
+	}
+
+	if c == 'n' {
+		if err := d.literal("null"); err != nil {
+			return err
+		}
+		// like encoding/json, null only changes values that can be nil
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return typeError(jsonTypeName(c), v.Type())
+		}
+		if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() {
+			// like encoding/json, decode into what the pointer points to
+			return d.value(v.Elem().Elem())
+		}
+		value, err := d.plain()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	switch c {
+	case '"':
+		return d.string(v)
+	case '{':
+		switch v.Kind() {
+		case reflect.Map:
+			return d.mapValue(v)
+		case reflect.Struct:
+			return d.structValue(v)
+		}
+	case '[':
+		switch v.Kind() {
+		case reflect.Slice:
+			return d.slice(v)
+		case reflect.Array:
+			return d.array(v)
+		}
+	case 't', 'f':
+		if v.Kind() == reflect.Bool {
+			word := "false"
+			if c == 't' {
+				word = "true"
+			}
+			if err := d.literal(word); err != nil {
+				return err
+			}
+			v.SetBool(c == 't')
+			return nil
+		}
+	default:
+		text, err := d.number()
+		if err != nil {
+			return err
+		}
+		return setNumber(v, text)
+	}
+	return typeError(jsonTypeName(c), v.Type())
+}
+
+// raw reads the next value and returns a copy of its JSON, for decoders outside
+// the driver, which can keep it
+func (d *rowDecoder) raw() ([]byte, error) {
+	d.peek()
+	start := d.pos
+	if err := d.skip(); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(d.data[start:d.pos]), nil
+}
+
+func (d *rowDecoder) string(v reflect.Value) error {
+	s, err := d.str()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(s))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// like encoding/json, []byte is a base64 string
+			b := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
+			n, err := base64.StdEncoding.Decode(b, s)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(b[:n])
+			return nil
+		}
+	}
+	return typeError("string", v.Type())
+}
+
+// setNumber stores the number with the given JSON text into v
+func setNumber(v reflect.Value, text []byte) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := parseInt(text)
+		if !ok {
+			// the server sends large numbers like 1e+21
+			f, err := strconv.ParseFloat(string(text), 64)
+			if err != nil || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return typeError("number", v.Type())
+			}
+			n = int64(f)
+		}
+		if v.OverflowInt(n) {
+			return typeError("number", v.Type())
+		}
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := parseUint(text)
+		if !ok {
+			f, err := strconv.ParseFloat(string(text), 64)
+			if err != nil || f < 0 || f != math.Trunc(f) || f >= math.MaxUint64 {
+				return typeError("number", v.Type())
+			}
+			n = uint64(f)
+		}
+		if v.OverflowUint(n) {
+			return typeError("number", v.Type())
+		}
+		v.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(string(text), 64)
+		if err != nil || v.OverflowFloat(f) {
+			return typeError("number", v.Type())
+		}
+		v.SetFloat(f)
+
+	case reflect.String:
+		if v.Type() != numberType {
+			return typeError("number", v.Type())
+		}
+		v.SetString(string(text))
+
+	default:
+		return typeError("number", v.Type())
+	}
+	return nil
+}
+
+func (d *rowDecoder) slice(v reflect.Value) error {
+	// start a new slice rather than overwriting the old one's elements, so that
+	// rows don't share memory
+	v.SetZero()
+	more, err := d.open('[', ']')
+	for i := 0; err == nil && more; i++ {
+		if i == v.Cap() {
+			// grow like encoding/json does
+			v.Grow(max(i/2, 4))
+		}
+		v.SetLen(i + 1)
+		if err = d.value(v.Index(i)); err != nil {
+			return atIndex(err, i)
+		}
+		more, err = d.more(']')
+	}
+	if err == nil && v.IsNil() {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return err
+}
+
+func (d *rowDecoder) array(v reflect.Value) error {
+	more, err := d.open('[', ']')
+	i := 0
+	for ; err == nil && more; i++ {
+		if i < v.Len() {
+			if err = d.value(v.Index(i)); err != nil {
+				return atIndex(err, i)
+			}
+		} else if err = d.skip(); err != nil {
+			return err
+		}
+		more, err = d.more(']')
+	}
+	for ; i < v.Len(); i++ {
+		v.Index(i).SetZero()
+	}
+	return err
+}
+
+func (d *rowDecoder) mapValue(v reflect.Value) error {
+	t := v.Type()
+	textKey := reflect.PointerTo(t.Key()).Implements(textUnmarshalerType)
+	if !textKey {
+		switch t.Key().Kind() {
+		case reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			return typeError("object", t)
+		}
+	}
+
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(t))
+	}
+	elem := reflect.New(t.Elem()).Elem()
+	more, err := d.open('{', '}')
+	for err == nil && more {
+		var key []byte
+		if key, err = d.key(); err != nil {
+			break
+		}
+		elem.SetZero()
+		if err = d.value(elem); err != nil {
+			return atKey(err, key)
+		}
+		var keyValue reflect.Value
+		if keyValue, err = mapKey(t.Key(), key, textKey); err != nil {
+			break
+		}
+		v.SetMapIndex(keyValue, elem)
+		more, err = d.more('}')
+	}
+	return err
+}
+
+// mapKey converts an attribute name to a map key, like encoding/json does
+func mapKey(t reflect.Type, key []byte, textKey bool) (reflect.Value, error) {
+	k := reflect.New(t)
+	if textKey {
+		if err := k.Interface().(encoding.TextUnmarshaler).UnmarshalText(bytes.Clone(key)); err != nil {
+			return reflect.Value{}, err
+		}
+		return k.Elem(), nil
+	}
+
+	k = k.Elem()
+	switch t.Kind() {
+	case reflect.String:
+		k.SetString(string(key))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(string(key), 10, 64)
+		if err != nil || k.OverflowInt(n) {
+			return reflect.Value{}, &decodeError{message: fmt.Sprintf("Cannot decode attribute %q into %v", key, t)}
+		}
+		k.SetInt(n)
+	default:
+		n, err := strconv.ParseUint(string(key), 10, 64)
+		if err != nil || k.OverflowUint(n) {
+			return reflect.Value{}, &decodeError{message: fmt.Sprintf("Cannot decode attribute %q into %v", key, t)}
+		}
+		k.SetUint(n)
+	}
+	return k, nil
+}
+
+func (d *rowDecoder) structValue(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+	more, err := d.open('{', '}')
+	for err == nil && more {
+		var key []byte
+		if key, err = d.key(); err != nil {
+			break
+		}
+		f := fields.byName(key)
+		switch {
+		case f != nil:
+			err = d.field(fieldByIndex(v, f.index), f)
+		case d.strict:
+			return &decodeError{message: fmt.Sprintf("Unknown attribute %q in %v", key, v.Type())}
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return atKey(err, key)
+		}
+		more, err = d.more('}')
+	}
+	return err
+}
+
+// field decodes the value of a struct field, for a field tagged ",string" the
+// value is a string holding the JSON for the field
+func (d *rowDecoder) field(v reflect.Value, f *field) error {
+	if !f.quoted || d.peek() != '"' {
+		return d.value(v)
+	}
+	s, err := d.str()
+	if err != nil {
+		return err
+	}
+	quoted := rowDecoder{scanner: scanner{data: s}, strict: d.strict}
+	if c := quoted.peek(); c == '{' || c == '[' || quoted.value(v) != nil || quoted.peek() != 0 {
+		return &decodeError{message: fmt.Sprintf("Cannot decode string %q into %v", s, v.Type())}
+	}
+	return nil
+}
+
+// plain decodes the next value the same as encoding/json does into an
+// interface{}
+func (d *rowDecoder) plain() (interface{}, error) {
+	switch c := d.peek(); c {
+	case '"':
+		s, err := d.str()
+		return string(s), err
+	case '{':
+		object := map[string]interface{}{}
+		more, err := d.open('{', '}')
+		for err == nil && more {
+			var key []byte
+			if key, err = d.key(); err != nil {
+				break
+			}
+			var value interface{}
+			if value, err = d.plain(); err != nil {
+				return nil, atKey(err, key)
+			}
+			object[string(key)] = value
+			more, err = d.more('}')
+		}
+		return object, err
+	case '[':
+		array := []interface{}{}
+		more, err := d.open('[', ']')
+		for err == nil && more {
+			var value interface{}
+			if value, err = d.plain(); err != nil {
+				return nil, atIndex(err, len(array))
+			}
+			array = append(array, value)
+			more, err = d.more(']')
+		}
+		return array, err
+	case 't':
+		return true, d.literal("true")
+	case 'f':
+		return false, d.literal("false")
+	case 'n':
+		return nil, d.literal("null")
+	}
+	text, err := d.number()
+	if err != nil {
+		return nil, err
+	}
+	f, err := strconv.ParseFloat(string(text), 64)
+	if err != nil {
+		return nil, typeError("number", reflect.TypeOf(f))
+	}
+	return f, nil
+}
+
+// fieldByIndex returns a nested field of a struct, allocating any nil
+// embedded struct pointers on the way.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// field is a struct field that's stored as an attribute of a row.
+type field struct {
+	name       string
+	index      []int
+	tagged     bool // the name came from a tag
+	omitEmpty  bool
+	primaryKey bool
+	quoted     bool // tagged ",string", the value is stored as a JSON string
+}
+
+type structFields []field
+
+// byName finds the field for an attribute, preferring an exact match.
+func (fields structFields) byName(name []byte) *field {
+	for i := range fields {
+		if fields[i].name == string(name) {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if bytes.EqualFold([]byte(fields[i].name), name) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+var fieldCache sync.Map // reflect.Type -> structFields
+
+// cachedFields returns the fields of a struct type that are stored in rows.
+func cachedFields(t reflect.Type) structFields {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.(structFields)
+	}
+	fields, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return fields.(structFields)
+}
+
+// typeFields lists the fields of a struct type, including the fields of
+// embedded structs.  If several fields have the same name, the least nested
+// one wins, then the one with a tag, the same as encoding/json.
+func typeFields(t reflect.Type) structFields {
+	var all []field
+	var depths []int
+	collectFields(t, nil, map[reflect.Type]bool{}, &all, &depths)
+
+	var fields structFields
+	for i, f := range all {
+		dominant := true
+		for j, other := range all {
+			if i == j || other.name != f.name {
+				continue
+			}
+			if depths[j] < depths[i] || (depths[j] == depths[i] && (other.tagged || !f.tagged)) {
+				dominant = false
+				break
+			}
+		}
+		if dominant {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func collectFields(t reflect.Type, index []int, visited map[reflect.Type]bool, fields *[]field, depths *[]int) {
+	if visited[t] {
+		return
+	}
+	visited[t] = true
+	defer delete(visited, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, options := fieldTag(sf)
+		if name == "-" && options == "" {
+			continue
+		}
+
+		fieldIndex := append(append([]int{}, index...), i)
+		if sf.Anonymous && name == "" {
+			embedded := sf.Type
+			if embedded.Kind() == reflect.Ptr {
+				if sf.PkgPath != "" {
+					// can't allocate a pointer to an unexported struct
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				collectFields(embedded, fieldIndex, visited, fields, depths)
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		f := field{name: name, index: fieldIndex, tagged: name != ""}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		for _, option := range strings.Split(options, ",") {
+			switch option {
+			case "omitempty":
+				f.omitEmpty = true
+			case "primarykey":
+				f.primaryKey = true
+			case "string":
+				f.quoted = quotable(sf.Type)
+			}
+		}
+		*fields = append(*fields, f)
+		*depths = append(*depths, len(index))
+	}
+}
+
+// fieldTag returns the name and options from a field's `rethinkdb` tag, using
+// its `json` tag for anything the `rethinkdb` tag leaves out.
+func fieldTag(sf reflect.StructField) (name, options string) {
+	tag, ok := sf.Tag.Lookup("rethinkdb")
+	jsonTag, jsonOk := sf.Tag.Lookup("json")
+	if !ok {
+		tag, ok = jsonTag, jsonOk
+	}
+	if !ok {
+		return "", ""
+	}
+
+	name, options = tag, ""
+	if i := strings.Index(tag, ","); i >= 0 {
+		name, options = tag[:i], tag[i+1:]
+	}
+	if name == "" && jsonOk {
+		name = strings.SplitN(jsonTag, ",", 2)[0]
+	}
+	return name, options
+}
+
+// quotable returns true if ",string" applies to a field of type t, which like
+// encoding/json is the case for strings, numbers and booleans, or pointers to
+// them
+func quotable(t reflect.Type) bool {
+	if t.Name() == "" && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
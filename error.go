@@ -1,12 +1,22 @@
 package rethinkgo
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	p "github.com/christopherhesse/rethinkgo/query_language"
+	"net"
+	"regexp"
 )
 
-func formatError(message string, response *p.Response) string {
-	return fmt.Sprintf("rethinkdb: %v: %v %v", message, response.GetErrorMessage(), getBacktraceFrames(response))
+func formatError(message string, response *p.Response, origin *errorOrigin) string {
+	return fmt.Sprintf("rethinkdb: %v: %v %v%v", message, response.GetErrorMessage(), getBacktraceFrames(response), origin)
+}
+
+// statusResponse makes a response to store in ErrNoSuchRow or
+// ErrWrongResponseType, so that they can report the status that was received
+func statusResponse(status p.Response_StatusCode, token int64) *p.Response {
+	return &p.Response{StatusCode: status.Enum(), Token: &token}
 }
 
 func getBacktraceFrames(response *p.Response) []string {
@@ -25,10 +35,36 @@ func getBacktraceFrames(response *p.Response) []string {
 //   err := r.Table("heroes").ArrayToStream().ArrayToStream().Run(session).Err()
 type ErrBadQuery struct {
 	response *p.Response
+	origin   *errorOrigin
 }
 
 func (e ErrBadQuery) Error() string {
-	return formatError("Server could not make sense of our query", e.response)
+	return formatError("Server could not make sense of our query", e.response, e.origin)
+}
+
+// Message returns the error message from the server.
+func (e ErrBadQuery) Message() string { return e.response.GetErrorMessage() }
+
+// Backtrace returns the frames of the backtrace from the server, which
+// describe where in the query the error happened.
+func (e ErrBadQuery) Backtrace() []string { return getBacktraceFrames(e.response) }
+
+// Token returns the token of the query that failed.
+func (e ErrBadQuery) Token() int64 { return e.response.GetToken() }
+
+// Expression returns the part of the query that the backtrace points at, as
+// formatted by Exp.String(), or "" if it could not be found.
+func (e ErrBadQuery) Expression() string { return e.origin.getExpression() }
+
+// CallSite returns the file and line where the part of the query that the
+// backtrace points at was built, if SetDebugCallSites(true) was used, or "".
+func (e ErrBadQuery) CallSite() string { return e.origin.getCallSite() }
+
+// Is makes errors.Is(err, ErrBadQuery{}) true for any ErrBadQuery, and
+// supports the classifications of server errors, such as ErrTableNotFound.
+func (e ErrBadQuery) Is(target error) bool {
+	_, ok := target.(ErrBadQuery)
+	return ok || classifiedAs(e.Message(), target)
 }
 
 // ErrRuntime indicates that the server has encountered an error while
@@ -40,10 +76,36 @@ func (e ErrBadQuery) Error() string {
 //   err := r.RuntimeError("error time!").Run(session).Err()
 type ErrRuntime struct {
 	response *p.Response
+	origin   *errorOrigin
 }
 
 func (e ErrRuntime) Error() string {
-	return formatError("Server could not execute our query", e.response)
+	return formatError("Server could not execute our query", e.response, e.origin)
+}
+
+// Message returns the error message from the server.
+func (e ErrRuntime) Message() string { return e.response.GetErrorMessage() }
+
+// Backtrace returns the frames of the backtrace from the server, which
+// describe where in the query the error happened.
+func (e ErrRuntime) Backtrace() []string { return getBacktraceFrames(e.response) }
+
+// Token returns the token of the query that failed.
+func (e ErrRuntime) Token() int64 { return e.response.GetToken() }
+
+// Expression returns the part of the query that the backtrace points at, as
+// formatted by Exp.String(), or "" if it could not be found.
+func (e ErrRuntime) Expression() string { return e.origin.getExpression() }
+
+// CallSite returns the file and line where the part of the query that the
+// backtrace points at was built, if SetDebugCallSites(true) was used, or "".
+func (e ErrRuntime) CallSite() string { return e.origin.getCallSite() }
+
+// Is makes errors.Is(err, ErrRuntime{}) true for any ErrRuntime, and supports
+// the classifications of server errors, such as ErrTableNotFound.
+func (e ErrRuntime) Is(target error) bool {
+	_, ok := target.(ErrRuntime)
+	return ok || classifiedAs(e.Message(), target)
 }
 
 // ErrBrokenClient means the server believes there's a bug in the client
@@ -53,7 +115,22 @@ type ErrBrokenClient struct {
 }
 
 func (e ErrBrokenClient) Error() string {
-	return formatError("Whoops, looks like there's a bug in this client library, please report it at https://github.com/christopherhesse/rethinkgo/issues/new", e.response)
+	return formatError("Whoops, looks like there's a bug in this client library, please report it at https://github.com/christopherhesse/rethinkgo/issues/new", e.response, nil)
+}
+
+// Message returns the error message from the server.
+func (e ErrBrokenClient) Message() string { return e.response.GetErrorMessage() }
+
+// Backtrace returns the frames of the backtrace from the server.
+func (e ErrBrokenClient) Backtrace() []string { return getBacktraceFrames(e.response) }
+
+// Token returns the token of the query that failed.
+func (e ErrBrokenClient) Token() int64 { return e.response.GetToken() }
+
+// Is makes errors.Is(err, ErrBrokenClient{}) true for any ErrBrokenClient.
+func (e ErrBrokenClient) Is(target error) bool {
+	_, ok := target.(ErrBrokenClient)
+	return ok
 }
 
 // ErrNoSuchRow is returned when there is an empty response from the server and
@@ -71,6 +148,16 @@ func (e ErrNoSuchRow) Error() string {
 	return "rethinkdb: No such row found"
 }
 
+// Status returns the status of the response from the server, e.g.
+// SUCCESS_EMPTY.
+func (e ErrNoSuchRow) Status() p.Response_StatusCode { return e.response.GetStatusCode() }
+
+// Is makes errors.Is(err, ErrNoSuchRow{}) true for any ErrNoSuchRow.
+func (e ErrNoSuchRow) Is(target error) bool {
+	_, ok := target.(ErrNoSuchRow)
+	return ok
+}
+
 // ErrWrongResponseType is returned when .Exec(), .One(). or .Collect() have
 // been used, but the expected response type does not match the type we got
 // from the server.
@@ -84,5 +171,135 @@ type ErrWrongResponseType struct {
 }
 
 func (e ErrWrongResponseType) Error() string {
-	return "rethinkdb: Wrong response type, you may have used the wrong one of: .Exec(), .One(), .Collect()"
+	if e.response == nil {
+		return "rethinkdb: Wrong response type, you may have used the wrong one of: .Exec(), .One(), .Collect()"
+	}
+	return fmt.Sprintf("rethinkdb: Wrong response type %v, you may have used the wrong one of: .Exec(), .One(), .Collect()", e.Status())
+}
+
+// Status returns the status of the response from the server, e.g.
+// SUCCESS_STREAM if .One() was used on a query that returns a list.
+func (e ErrWrongResponseType) Status() p.Response_StatusCode { return e.response.GetStatusCode() }
+
+// Is makes errors.Is(err, ErrWrongResponseType{}) true for any
+// ErrWrongResponseType.
+func (e ErrWrongResponseType) Is(target error) bool {
+	_, ok := target.(ErrWrongResponseType)
+	return ok
+}
+
+// WriteError is returned when some rows of a write query failed to be
+// written, for instance because an inserted row's primary key already exists.
+// The rest of the rows may have been written, Response has the counts.  See
+// WriteResponse.Err() and Session.SetStrictWrites().
+//
+// Example usage:
+//
+//  session.SetStrictWrites(true)
+//  err := r.Table("heroes").Insert(heroes).Run(session).One(&response)
+//  var writeErr r.WriteError
+//  if errors.As(err, &writeErr) {
+//      fmt.Println(writeErr.Response.Errors, "rows failed:", writeErr.Response.FirstError)
+//  }
+type WriteError struct {
+	Response WriteResponse
+}
+
+func (e WriteError) Error() string {
+	return fmt.Sprintf("rethinkdb: %v rows failed to be written, the first error was: %v", e.Response.Errors, e.Response.FirstError)
+}
+
+// Is makes errors.Is(err, WriteError{}) true for any WriteError.
+func (e WriteError) Is(target error) bool {
+	_, ok := target.(WriteError)
+	return ok
+}
+
+// Classifications of errors reported by the server, for use with errors.Is,
+// see also IsTableNotFound() etc.
+//
+// Example usage:
+//
+//  err := r.TableCreate("heroes").Run(session).Exec()
+//  if errors.Is(err, r.ErrTableExists) {
+//      ...
+//  }
+var (
+	ErrTableNotFound    = errors.New("rethinkdb: Table does not exist")
+	ErrTableExists      = errors.New("rethinkdb: Table already exists")
+	ErrDatabaseNotFound = errors.New("rethinkdb: Database does not exist")
+	ErrDatabaseExists   = errors.New("rethinkdb: Database already exists")
+)
+
+// the server's messages for each classification
+var classifications = map[error]*regexp.Regexp{
+	ErrTableNotFound:    regexp.MustCompile("^Table `.*` does not exist"),
+	ErrTableExists:      regexp.MustCompile("^Table `.*` already exists"),
+	ErrDatabaseNotFound: regexp.MustCompile("^Database `.*` does not exist"),
+	ErrDatabaseExists:   regexp.MustCompile("^Database `.*` already exists"),
+}
+
+func classifiedAs(message string, target error) bool {
+	pattern, ok := classifications[target]
+	return ok && pattern.MatchString(message)
+}
+
+// IsTableNotFound returns true if err means that a table the query used does
+// not exist.
+func IsTableNotFound(err error) bool {
+	return errors.Is(err, ErrTableNotFound)
+}
+
+// IsTableExists returns true if err means that a table could not be created
+// because it already exists.
+func IsTableExists(err error) bool {
+	return errors.Is(err, ErrTableExists)
+}
+
+// IsDatabaseNotFound returns true if err means that a database the query used
+// does not exist.
+func IsDatabaseNotFound(err error) bool {
+	return errors.Is(err, ErrDatabaseNotFound)
+}
+
+// IsDatabaseExists returns true if err means that a database could not be
+// created because it already exists.
+//
+// Example usage:
+//
+//  err := r.DbCreate("marvel").Run(session).Exec()
+//  if err != nil && !r.IsDatabaseExists(err) {
+//      return err
+//  }
+func IsDatabaseExists(err error) bool {
+	return errors.Is(err, ErrDatabaseExists)
+}
+
+// IsTimeout returns true if err means that the server didn't respond in time,
+// because of the session's timeout, or the deadline of a context.
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// IsNetwork returns true if err was caused by the connection to the server
+// failing, as opposed to an error reported by the server or a timeout.
+func IsNetwork(err error) bool {
+	return isNetworkError(err)
+}
+
+// IsServerError returns true if err is an error response from the server, an
+// ErrRuntime, ErrBadQuery or ErrBrokenClient, as opposed to the query failing
+// before the server answered it.  This is useful in a QueryHook or Collector to
+// tell if there is a response status.
+//
+// Example usage:
+//
+//  func (c *collector) QueryDone(queryType p.Query_QueryType, status p.Response_StatusCode, err error, duration time.Duration) {
+//      if err == nil || r.IsServerError(err) {
+//          c.count(status)
+//      }
+//  }
+func IsServerError(err error) bool {
+	return errors.Is(err, ErrRuntime{}) || errors.Is(err, ErrBadQuery{}) || errors.Is(err, ErrBrokenClient{})
 }
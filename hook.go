@@ -0,0 +1,193 @@
+package rethinkgo
+
+import (
+	"context"
+	"fmt"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"log/slog"
+	"time"
+)
+
+// QueryInfo describes a query sent to the server, for a QueryHook.
+type QueryInfo struct {
+	// Token identifies the query, CONTINUE and STOP queries have the token of
+	// the query that started the stream
+	Token int64
+	// Type is the type of query, e.g. READ, WRITE, META, CONTINUE or STOP
+	Type p.Query_QueryType
+	// Query is the query formatted with its String() method, for CONTINUE and
+	// STOP queries it's the query that started the stream
+	Query string
+}
+
+// QueryHook is told about every query a session sends to the server, see
+// Session.SetQueryHook().
+type QueryHook interface {
+	// BeforeQuery is called before a query is sent, the context it returns is
+	// passed to AfterQuery, so it can carry something like a tracing span
+	BeforeQuery(ctx context.Context, info *QueryInfo) context.Context
+	// AfterQuery is called once the response has arrived, or the query has
+	// failed.  status is the status code of the response, which is only
+	// meaningful if err is nil or an error reported by the server, such as
+	// ErrRuntime.  rowCount is the number of rows in the response.
+	AfterQuery(ctx context.Context, info *QueryInfo, status p.Response_StatusCode, err error, duration time.Duration, rowCount int)
+}
+
+// SetQueryHook sets a hook that is called for every query this session sends
+// to the server, including the CONTINUE and STOP queries that read streams.
+// A nil hook removes the hook.
+//
+// Example usage:
+//
+//  session.SetQueryHook(r.SlogHook(slog.Default()))
+func (s *Session) SetQueryHook(hook QueryHook) {
+	s.hook = hook
+}
+
+// execute runs a query on a connection, and tells the session's hook and
+// collector about it, query is the query that was run, or the query that
+// started the stream for CONTINUE and STOP queries
+func (s *Session) execute(ctx context.Context, conn *connection, queryProto *p.Query, query Query) ([]string, p.Response_StatusCode, error) {
+	hook, collector := s.hook, s.opts.Collector
+	if hook == nil && collector == nil {
+		return conn.executeQuery(ctx, queryProto, s.timeout)
+	}
+
+	var info *QueryInfo
+	hookCtx := ctx
+	if hook != nil {
+		info = &QueryInfo{Token: queryProto.GetToken(), Type: queryProto.GetType()}
+		if query != nil {
+			info.Query = fmt.Sprint(query)
+		}
+		hookCtx = hook.BeforeQuery(ctx, info)
+	}
+
+	start := time.Now()
+	result, status, err := conn.executeQuery(ctx, queryProto, s.timeout)
+	duration := time.Since(start)
+
+	if hook != nil {
+		hook.AfterQuery(hookCtx, info, status, err, duration, len(result))
+	}
+	if collector != nil {
+		collector.QueryDone(queryProto.GetType(), status, err, duration)
+	}
+	return result, status, err
+}
+
+type slogHook struct {
+	logger *slog.Logger
+}
+
+// SlogHook returns a QueryHook that logs every query to logger once it's done,
+// at level Debug, or level Error if the query failed.
+//
+// Example usage:
+//
+//  session.SetQueryHook(r.SlogHook(slog.Default()))
+//
+// Example output:
+//
+//  level=DEBUG msg="rethinkdb query" token=1 type=READ query=Table("heroes") duration=1.2ms status=SUCCESS_STREAM rows=3
+func SlogHook(logger *slog.Logger) QueryHook {
+	return slogHook{logger: logger}
+}
+
+func (h slogHook) BeforeQuery(ctx context.Context, info *QueryInfo) context.Context {
+	return ctx
+}
+
+func (h slogHook) AfterQuery(ctx context.Context, info *QueryInfo, status p.Response_StatusCode, err error, duration time.Duration, rowCount int) {
+	level := slog.LevelDebug
+	attrs := []slog.Attr{
+		slog.Int64("token", info.Token),
+		slog.String("type", info.Type.String()),
+		slog.String("query", info.Query),
+		slog.Duration("duration", duration),
+	}
+	if err == nil || IsServerError(err) {
+		attrs = append(attrs, slog.String("status", status.String()), slog.Int("rows", rowCount))
+	}
+	if err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	h.logger.LogAttrs(ctx, level, "rethinkdb query", attrs...)
+}
+
+// Span is a span of a trace, like an OpenTelemetry span, see TracingHook().
+type Span interface {
+	SetAttribute(key string, value interface{})
+	SetError(err error)
+	End()
+}
+
+// StartSpan starts a span, as a child of any span in ctx, and returns a
+// context containing the new span.
+type StartSpan func(ctx context.Context, name string) (context.Context, Span)
+
+type tracingHook struct {
+	start StartSpan
+}
+
+// the key of the span in the context passed from BeforeQuery to AfterQuery
+type spanKey struct{}
+
+// TracingHook returns a QueryHook that records a span for each query, named
+// after the type of query, e.g. "rethinkdb READ".  Spans have the attributes
+// "db.system", "db.operation" and "db.statement" from the OpenTelemetry
+// conventions for databases, and "rethinkdb.token", "rethinkdb.status" and
+// "rethinkdb.rows".
+//
+// Example usage with OpenTelemetry:
+//
+//  type otelSpan struct {
+//      span trace.Span
+//  }
+//
+//  func (s otelSpan) SetAttribute(key string, value interface{}) {
+//      s.span.SetAttributes(attribute.String(key, fmt.Sprint(value)))
+//  }
+//
+//  func (s otelSpan) SetError(err error) {
+//      s.span.RecordError(err)
+//      s.span.SetStatus(codes.Error, err.Error())
+//  }
+//
+//  func (s otelSpan) End() {
+//      s.span.End()
+//  }
+//
+//  tracer := otel.Tracer("rethinkdb")
+//  session.SetQueryHook(r.TracingHook(func(ctx context.Context, name string) (context.Context, r.Span) {
+//      ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+//      return ctx, otelSpan{span}
+//  }))
+func TracingHook(start StartSpan) QueryHook {
+	return tracingHook{start: start}
+}
+
+func (h tracingHook) BeforeQuery(ctx context.Context, info *QueryInfo) context.Context {
+	ctx, span := h.start(ctx, "rethinkdb "+info.Type.String())
+	span.SetAttribute("db.system", "rethinkdb")
+	span.SetAttribute("db.operation", info.Type.String())
+	span.SetAttribute("db.statement", info.Query)
+	span.SetAttribute("rethinkdb.token", info.Token)
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func (h tracingHook) AfterQuery(ctx context.Context, info *QueryInfo, status p.Response_StatusCode, err error, duration time.Duration, rowCount int) {
+	span, ok := ctx.Value(spanKey{}).(Span)
+	if !ok {
+		return
+	}
+	if err == nil || IsServerError(err) {
+		span.SetAttribute("rethinkdb.status", status.String())
+		span.SetAttribute("rethinkdb.rows", rowCount)
+	}
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,291 @@
+package rethinkgo
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LeakDetector finds Rows iterators that are never closed.  An iterator that
+// is reading a stream holds a connection until it's closed or it reaches the
+// end of the stream, so forgotten iterators can use up the connection pool.
+// See Session.SetLeakDetector().
+type LeakDetector struct {
+	// MaxAge is how long an iterator can hold a connection before it's
+	// reported, zero means iterators are never reported for their age
+	MaxAge time.Duration
+	// Report is called once for each iterator that is reported, if it's nil
+	// the iterator is logged with the "log" package
+	Report func(info IteratorInfo)
+	// CloseLeaked closes iterators that are garbage collected while they still
+	// hold a connection, so the connection goes back to the pool, and reports
+	// them if they haven't been reported already
+	CloseLeaked bool
+}
+
+// IteratorInfo describes a Rows iterator that holds a connection, see
+// Session.OpenIterators().
+type IteratorInfo struct {
+	// Token is the token of the query the iterator reads the results of
+	Token int64
+	// Query is the query, formatted with its String() method
+	Query string
+	// Opened is when the iterator was created
+	Opened time.Time
+	// Stack lists the function calls that created the iterator, it's only
+	// recorded while the session has a leak detector
+	Stack string
+	// GarbageCollected is true if the iterator was garbage collected without
+	// being closed, see LeakDetector.CloseLeaked
+	GarbageCollected bool
+}
+
+// String describes the iterator for a log message.
+func (info IteratorInfo) String() string {
+	s := fmt.Sprintf("rethinkdb: Rows iterator for %v has been open since %v", info.Query, info.Opened.Format(time.RFC3339))
+	if info.GarbageCollected {
+		s += " and was garbage collected without being closed"
+	}
+	if info.Stack != "" {
+		s += ", it was created at:\n" + info.Stack
+	}
+	return s
+}
+
+// streamState tracks the stream held by a Rows iterator, see Rows.openStream()
+type streamState struct {
+	released atomic.Bool
+	token    int64
+	query    Query
+	opened   time.Time
+	stack    string
+	// set once the iterator has been reported, protected by the session's mutex
+	reported bool
+}
+
+func (stream *streamState) info() IteratorInfo {
+	info := IteratorInfo{Token: stream.token, Opened: stream.opened, Stack: stream.stack}
+	if stream.query != nil {
+		info.Query = fmt.Sprint(stream.query)
+	}
+	return info
+}
+
+// SetLeakDetector sets the leak detector for Rows iterators created from now
+// on, nil turns leak detection off.  The leak detector records where each
+// iterator is created, which makes creating iterators slower, so it's meant for
+// debugging.
+//
+// Example usage:
+//
+//  session.SetLeakDetector(&r.LeakDetector{MaxAge: time.Minute, CloseLeaked: true})
+//
+// Example output:
+//
+//  rethinkdb: Rows iterator for Table("heroes") has been open since 2013-01-02T15:04:05Z, it was created at:
+//  main.listHeroes
+//      /home/user/heroes.go:12
+//  main.main
+//      /home/user/main.go:8
+func (s *Session) SetLeakDetector(detector *LeakDetector) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if detector != nil {
+		// so that the detector can't be changed behind our back
+		copied := *detector
+		detector = &copied
+	}
+	s.leakDetector = detector
+	if !s.closed {
+		s.startLeakCheck()
+	}
+}
+
+// OpenIterators lists the Rows iterators that hold one of the session's
+// connections, oldest first.  An iterator holds a connection while it reads a
+// stream, until it's closed or has reached the end of the stream.
+//
+// Example usage:
+//
+//  for _, iterator := range session.OpenIterators() {
+//      fmt.Println(iterator)
+//  }
+func (s *Session) OpenIterators() []IteratorInfo {
+	s.mutex.Lock()
+	streams := s.sortedStreamsLocked()
+	s.mutex.Unlock()
+
+	infos := make([]IteratorInfo, len(streams))
+	for i, stream := range streams {
+		infos[i] = stream.info()
+	}
+	return infos
+}
+
+// sortedStreamsLocked returns the open streams, oldest first.  s.mutex must be
+// held.
+func (s *Session) sortedStreamsLocked() []*streamState {
+	streams := make([]*streamState, 0, len(s.streams))
+	for stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].opened.Before(streams[j].opened)
+	})
+	return streams
+}
+
+// startLeakCheck starts a goroutine that reports iterators that have been open
+// for longer than the leak detector's MaxAge, stopping the previous one if
+// there is one.  s.mutex must be held.
+func (s *Session) startLeakCheck() {
+	if s.stopLeakCheck != nil {
+		close(s.stopLeakCheck)
+		s.stopLeakCheck = nil
+	}
+	detector := s.leakDetector
+	if detector == nil || detector.MaxAge <= 0 {
+		return
+	}
+
+	interval := detector.MaxAge / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	stop := make(chan struct{})
+	s.stopLeakCheck = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.reportOld(detector)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// reportOld reports the iterators that have been open for too long
+func (s *Session) reportOld(detector *LeakDetector) {
+	now := time.Now()
+	var old []*streamState
+	s.mutex.Lock()
+	for _, stream := range s.sortedStreamsLocked() {
+		if !stream.reported && now.Sub(stream.opened) > detector.MaxAge {
+			stream.reported = true
+			old = append(old, stream)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, stream := range old {
+		detector.report(stream.info())
+	}
+}
+
+func (detector *LeakDetector) report(info IteratorInfo) {
+	if detector.Report != nil {
+		detector.Report(info)
+	} else {
+		log.Print(info)
+	}
+}
+
+// openStream is called when the iterator starts holding a connection to read
+// a stream from
+func (rows *Rows) openStream(query Query) {
+	s := rows.session
+	stream := &streamState{token: rows.token, query: query, opened: time.Now()}
+	rows.stream = stream
+
+	s.mutex.Lock()
+	detector := s.leakDetector
+	s.mutex.Unlock()
+	if detector != nil {
+		stream.stack = callStack()
+	}
+
+	s.mutex.Lock()
+	if s.streams == nil {
+		s.streams = map[*streamState]bool{}
+	}
+	s.streams[stream] = true
+	s.mutex.Unlock()
+
+	collector := s.opts.Collector
+	if collector != nil {
+		collector.StreamsChanged(1)
+	}
+	if collector == nil && (detector == nil || !detector.CloseLeaked) {
+		return
+	}
+
+	runtime.SetFinalizer(rows, func(rows *Rows) {
+		if rows.stream.released.Load() {
+			return
+		}
+		if collector != nil {
+			collector.StreamLeaked()
+		}
+		if detector == nil || !detector.CloseLeaked {
+			return
+		}
+
+		s.mutex.Lock()
+		reported := stream.reported
+		stream.reported = true
+		s.mutex.Unlock()
+		if !reported {
+			info := stream.info()
+			info.GarbageCollected = true
+			detector.report(info)
+		}
+		// closing the iterator sends a query to the server, which shouldn't
+		// hold up other finalizers
+		go rows.Close()
+	})
+}
+
+// releaseStream is called when the iterator lets go of its connection, it's
+// safe to call more than once
+func (rows *Rows) releaseStream() {
+	stream := rows.stream
+	if stream == nil || !stream.released.CompareAndSwap(false, true) {
+		return
+	}
+
+	s := rows.session
+	s.mutex.Lock()
+	delete(s.streams, stream)
+	s.mutex.Unlock()
+	if collector := s.opts.Collector; collector != nil {
+		collector.StreamsChanged(-1)
+	}
+}
+
+// callStack lists the function calls outside of this package that led to the
+// current one
+func callStack() string {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	var stack strings.Builder
+	for {
+		frame, more := frames.Next()
+		inPackage := strings.HasPrefix(frame.Function, packagePrefix) && !strings.HasSuffix(frame.File, "_test.go")
+		if !inPackage && !strings.HasPrefix(frame.Function, "runtime.") {
+			fmt.Fprintf(&stack, "%v\n\t%v:%v\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			return stack.String()
+		}
+	}
+}
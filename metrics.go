@@ -0,0 +1,43 @@
+package rethinkgo
+
+import (
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"time"
+)
+
+// Collector receives measurements from a session for monitoring, set it with
+// ConnectOpts.Collector.  One Collector can be shared by several sessions, the
+// measurements of connections and streams are changes, so that they add up.
+//
+// The methods are called while queries run, sometimes while the session's lock
+// is held, so they must be quick and must not use the session.  The
+// rethinkprom package has a Collector for Prometheus.
+type Collector interface {
+	// QueryDone is called once the server has answered a query, or the query
+	// has failed.  status is only meaningful if err is nil or an error reported
+	// by the server, such as ErrRuntime.
+	QueryDone(queryType p.Query_QueryType, status p.Response_StatusCode, err error, duration time.Duration)
+	// MessageSent is called for every message written to a connection, with
+	// its size in bytes, including the length in front of it
+	MessageSent(bytes int)
+	// MessageReceived is called for every message read from a connection
+	MessageReceived(bytes int)
+	// ConnsChanged is called when connections are opened, closed, taken from
+	// the pool or returned to it, with the change in the number of idle, in use
+	// and dialing connections
+	ConnsChanged(idle, inUse, dialing int)
+	// StreamsChanged is called with 1 when a Rows iterator starts holding a
+	// connection to read a stream, and with -1 when it lets go of it
+	StreamsChanged(delta int)
+	// StreamLeaked is called when a Rows iterator is garbage collected while it
+	// still holds a connection, because it was never closed
+	StreamLeaked()
+}
+
+// connsChanged tells the session's collector, if any, about a change to its
+// connections
+func (s *Session) connsChanged(idle, inUse, dialing int) {
+	if collector := s.opts.Collector; collector != nil {
+		collector.ConnsChanged(idle, inUse, dialing)
+	}
+}
@@ -0,0 +1,296 @@
+// Package migrate applies versioned changes to a RethinkDB schema, such as
+// creating tables and back-filling data, and records which ones have been
+// applied in a bookkeeping table.
+//
+// Each Migration has a version, migrations are applied in order of version
+// by Migrator.Up() and undone, newest first, by Migrator.Down().  Migrations
+// should be safe to run again if they fail part way through, the CreateTable()
+// and DropTable() helpers skip tables that already exist or are already gone.
+//
+// Example usage:
+//
+//  migrations := []migrate.Migration{
+//      {
+//          Version: 1,
+//          Name:    "create heroes",
+//          Up: func(ctx context.Context, session *r.Session) error {
+//              return migrate.CreateTable(ctx, session, r.TableSpec{Name: "heroes", PrimaryKey: "name"})
+//          },
+//          Down: func(ctx context.Context, session *r.Session) error {
+//              return migrate.DropTable(ctx, session, "heroes")
+//          },
+//      },
+//      {
+//          Version: 2,
+//          Name:    "give heroes a strength",
+//          Up: func(ctx context.Context, session *r.Session) error {
+//              update := r.Table("heroes").Update(r.Map{"strength": 1})
+//              response, err := r.RunWriteContext(ctx, update, session)
+//              if err != nil {
+//                  return err
+//              }
+//              // rows that failed to update don't make the query fail
+//              return response.Err()
+//          },
+//      },
+//  }
+//
+//  migrator := migrate.New(session, migrations...)
+//  if err := migrator.Up(ctx); err != nil {
+//      log.Fatal(err)
+//  }
+package migrate
+
+import (
+	"context"
+	"fmt"
+	r "github.com/christopherhesse/rethinkgo"
+	"sort"
+	"time"
+)
+
+// DefaultTable is the name of the table that records applied migrations,
+// unless Migrator.SetTable() is used.
+const DefaultTable = "migrations"
+
+// Migration is a single versioned change to a schema.
+type Migration struct {
+	// Version orders the migrations, and must be unique
+	Version int64
+	// Name describes the migration in Status()
+	Name string
+	// Up applies the migration
+	Up func(ctx context.Context, session *r.Session) error
+	// Down undoes the migration, it may be nil if the migration can't be undone
+	Down func(ctx context.Context, session *r.Session) error
+}
+
+// Status describes whether a migration has been applied, see
+// Migrator.Status().
+type Status struct {
+	Version int64
+	Name    string
+	Applied bool
+	// AppliedAt is when the migration was applied, if it has been
+	AppliedAt time.Time
+}
+
+// record is a row of the bookkeeping table
+type record struct {
+	Version   int64  `rethinkdb:"id"`
+	Name      string `rethinkdb:"name"`
+	AppliedAt int64  `rethinkdb:"applied_at"` // unix time
+}
+
+// Migrator applies migrations using a session, see New().
+type Migrator struct {
+	session    *r.Session
+	table      string
+	migrations []Migration
+}
+
+// New creates a Migrator for the given migrations, which are sorted by
+// version.  The bookkeeping table is in the session's database.
+func New(session *r.Session, migrations ...Migration) *Migrator {
+	sorted := append([]Migration{}, migrations...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return &Migrator{session: session, table: DefaultTable, migrations: sorted}
+}
+
+// SetTable changes the name of the bookkeeping table.
+//
+// Example usage:
+//
+//  migrator.SetTable("schema_versions")
+func (m *Migrator) SetTable(name string) {
+	m.table = name
+}
+
+// check makes sure the migrations are usable
+func (m *Migrator) check() error {
+	for i, migration := range m.migrations {
+		if migration.Up == nil {
+			return fmt.Errorf("migrate: Migration %v has no Up function", migration.Version)
+		}
+		if i > 0 && m.migrations[i-1].Version == migration.Version {
+			return fmt.Errorf("migrate: More than one migration has version %v", migration.Version)
+		}
+	}
+	return nil
+}
+
+// applied returns the records of applied migrations.  If the bookkeeping table
+// doesn't exist yet, it's created if create is true, otherwise no migrations
+// have been applied.
+func (m *Migrator) applied(ctx context.Context, create bool) (map[int64]record, error) {
+	applied := map[int64]record{}
+	if create {
+		if err := CreateTable(ctx, m.session, r.TableSpec{Name: m.table}); err != nil {
+			return nil, err
+		}
+	} else {
+		exists, err := tableExists(ctx, m.session, m.table)
+		if err != nil || !exists {
+			return applied, err
+		}
+	}
+
+	var records []record
+	err := m.session.RunContext(ctx, r.Table(m.table)).CollectContext(ctx, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range records {
+		applied[rec.Version] = rec
+	}
+	return applied, nil
+}
+
+// Up applies all migrations that haven't been applied yet, in order of
+// version, recording each one as it's applied.  If a migration fails, Up stops
+// and returns its error, the migrations before it stay applied.
+func (m *Migrator) Up(ctx context.Context) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := migration.Up(ctx, m.session); err != nil {
+			return fmt.Errorf("migrate: Migration %v (%v) failed: %w", migration.Version, migration.Name, err)
+		}
+
+		rec := record{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now().Unix()}
+		if err := m.write(ctx, r.Table(m.table).Insert(rec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down undoes the most recently applied migration (the one with the highest
+// version), and removes its record.  It does nothing if no migrations have been
+// applied.
+func (m *Migrator) Down(ctx context.Context) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == nil {
+			return fmt.Errorf("migrate: Migration %v (%v) can't be undone", migration.Version, migration.Name)
+		}
+		if err := migration.Down(ctx, m.session); err != nil {
+			return fmt.Errorf("migrate: Undoing migration %v (%v) failed: %w", migration.Version, migration.Name, err)
+		}
+		return m.write(ctx, r.Table(m.table).GetById(migration.Version).Delete())
+	}
+	return nil
+}
+
+// Status lists all migrations in order of version and whether they have been
+// applied.  It doesn't write anything, not even the bookkeeping table.
+//
+// Example usage:
+//
+//  statuses, err := migrator.Status(ctx)
+//  for _, status := range statuses {
+//      fmt.Println(status.Version, status.Name, status.Applied)
+//  }
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, migration := range m.migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if rec, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = time.Unix(rec.AppliedAt, 0)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// write runs a write query on the bookkeeping table
+func (m *Migrator) write(ctx context.Context, query r.WriteQuery) error {
+	response, err := r.RunWriteContext(ctx, query, m.session)
+	if err != nil {
+		return err
+	}
+	if response.Errors > 0 {
+		return fmt.Errorf("migrate: Updating %v failed: %v", m.table, response.FirstError)
+	}
+	return nil
+}
+
+// CreateTable creates a table in the session's database unless it already
+// exists.
+func CreateTable(ctx context.Context, session *r.Session, spec r.TableSpec) error {
+	exists, err := tableExists(ctx, session, spec.Name)
+	if err != nil || exists {
+		return err
+	}
+	return session.RunContext(ctx, r.TableCreateSpec(spec)).ExecContext(ctx)
+}
+
+// DropTable drops a table from the session's database, unless it doesn't exist.
+func DropTable(ctx context.Context, session *r.Session, name string) error {
+	exists, err := tableExists(ctx, session, name)
+	if err != nil || !exists {
+		return err
+	}
+	return session.RunContext(ctx, r.TableDrop(name)).ExecContext(ctx)
+}
+
+// CreateDatabase creates a database unless it already exists.
+func CreateDatabase(ctx context.Context, session *r.Session, name string) error {
+	var databases []string
+	err := session.RunContext(ctx, r.DbList()).CollectContext(ctx, &databases)
+	if err != nil {
+		return err
+	}
+	for _, database := range databases {
+		if database == name {
+			return nil
+		}
+	}
+	return session.RunContext(ctx, r.DbCreate(name)).ExecContext(ctx)
+}
+
+func tableExists(ctx context.Context, session *r.Session, name string) (bool, error) {
+	var tables []string
+	err := session.RunContext(ctx, r.TableList()).CollectContext(ctx, &tables)
+	if err != nil {
+		return false, err
+	}
+	for _, table := range tables {
+		if table == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
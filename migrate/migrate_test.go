@@ -0,0 +1,141 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	r "github.com/christopherhesse/rethinkgo"
+	"github.com/christopherhesse/rethinkgo/rethinkgotest"
+	. "launchpad.net/gocheck"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type MigrateSuite struct {
+	server  *rethinkgotest.Server
+	session *r.Session
+}
+
+var _ = Suite(&MigrateSuite{})
+
+func (s *MigrateSuite) SetUpTest(c *C) {
+	s.server = rethinkgotest.NewLocalServer()
+	s.server.Handle(rethinkgotest.Any(), rethinkgotest.NewDB().Handle)
+
+	var err error
+	s.session, err = r.ConnectWithOpts(r.ConnectOpts{Database: "test", Dial: s.server.Dial})
+	c.Assert(err, IsNil)
+}
+
+func (s *MigrateSuite) TearDownTest(c *C) {
+	s.session.Close()
+	s.server.Close()
+}
+
+func (s *MigrateSuite) tables(c *C) []string {
+	var tables []string
+	err := r.TableList().Run(s.session).Collect(&tables)
+	c.Assert(err, IsNil)
+	return tables
+}
+
+// write runs a write query, failing if any rows fail to be written
+func write(ctx context.Context, session *r.Session, query r.WriteQuery) error {
+	response, err := r.RunWriteContext(ctx, query, session)
+	if err != nil {
+		return err
+	}
+	return response.Err()
+}
+
+var migrations = []Migration{
+	{
+		Version: 2,
+		Name:    "give heroes a strength",
+		Up: func(ctx context.Context, session *r.Session) error {
+			insert := r.Table("heroes").Insert(r.Map{"name": "Superman", "strength": 10})
+			return write(ctx, session, insert)
+		},
+		Down: func(ctx context.Context, session *r.Session) error {
+			return write(ctx, session, r.Table("heroes").Delete())
+		},
+	},
+	{
+		Version: 1,
+		Name:    "create heroes",
+		Up: func(ctx context.Context, session *r.Session) error {
+			return CreateTable(ctx, session, r.TableSpec{Name: "heroes", PrimaryKey: "name"})
+		},
+		Down: func(ctx context.Context, session *r.Session) error {
+			return DropTable(ctx, session, "heroes")
+		},
+	},
+}
+
+func (s *MigrateSuite) TestUpDown(c *C) {
+	ctx := context.Background()
+	migrator := New(s.session, migrations...)
+
+	statuses, err := migrator.Status(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, HasLen, 2)
+	c.Assert(statuses[0].Version, Equals, int64(1))
+	c.Assert(statuses[0].Applied, Equals, false)
+	// Status doesn't create the bookkeeping table
+	c.Assert(s.tables(c), HasLen, 0)
+
+	c.Assert(migrator.Up(ctx), IsNil)
+	c.Assert(s.tables(c), DeepEquals, []string{"heroes", "migrations"})
+	statuses, err = migrator.Status(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(statuses[1].Applied, Equals, true)
+	c.Assert(statuses[1].AppliedAt.IsZero(), Equals, false)
+
+	// applied migrations aren't run again
+	c.Assert(migrator.Up(ctx), IsNil)
+	var count int
+	err = r.Table("heroes").Count().Run(s.session).One(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+
+	c.Assert(migrator.Down(ctx), IsNil)
+	err = r.Table("heroes").Count().Run(s.session).One(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 0)
+	c.Assert(migrator.Down(ctx), IsNil)
+	c.Assert(s.tables(c), DeepEquals, []string{"migrations"})
+	c.Assert(migrator.Down(ctx), IsNil)
+
+	statuses, err = migrator.Status(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(statuses[0].Applied, Equals, false)
+	c.Assert(statuses[1].Applied, Equals, false)
+}
+
+func (s *MigrateSuite) TestFailure(c *C) {
+	ctx := context.Background()
+	errBroken := errors.New("broken")
+	broken := Migration{
+		Version: 3,
+		Name:    "broken",
+		Up: func(ctx context.Context, session *r.Session) error {
+			return errBroken
+		},
+	}
+	migrator := New(s.session, append(migrations, broken)...)
+	migrator.SetTable("versions")
+
+	// the table already exists, so creating it is skipped
+	c.Assert(r.TableCreate("heroes").Run(s.session).Exec(), IsNil)
+
+	err := migrator.Up(ctx)
+	c.Assert(errors.Is(err, errBroken), Equals, true)
+	c.Assert(err, ErrorMatches, "migrate: Migration 3 \\(broken\\) failed: broken")
+	statuses, err := migrator.Status(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(statuses[1].Applied, Equals, true)
+	c.Assert(statuses[2].Applied, Equals, false)
+
+	duplicate := New(s.session, migrations[0], migrations[0])
+	c.Assert(duplicate.Up(ctx), ErrorMatches, "migrate: More than one migration has version 2")
+}
@@ -0,0 +1,431 @@
+package rethinkgo
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// default number of idle connections to a server to keep laying around
+const defaultMaxIdle = 5
+
+// errSessionClosed is returned for queries run after Session.Close()
+var errSessionClosed = errors.New("rethinkdb: session is closed")
+
+// PoolConfig controls the pool of connections that a Session keeps to the
+// server.  The zero value gives the same behavior as Connect(): up to 5 idle
+// connections are kept around and there is no limit on the number of open
+// connections.
+//
+// Example usage:
+//
+//  pool := r.PoolConfig{
+//      MaxIdle:     10,
+//      MaxOpen:     50,
+//      IdleTimeout: 5 * time.Minute,
+//      HealthCheck: true,
+//  }
+//  sess, err := r.ConnectWithPool("localhost:28015", "test", pool)
+type PoolConfig struct {
+	// MaxIdle is the maximum number of idle connections to keep for later
+	// queries.  Zero means the default of 5, a negative value means no idle
+	// connections are kept.
+	MaxIdle int
+	// MaxOpen is the maximum number of connections open at once, including the
+	// ones in use.  Once the limit is reached, queries wait for a connection to
+	// be returned to the pool.  Zero means no limit.
+	MaxOpen int
+	// IdleTimeout closes connections that have been idle for longer than this.
+	// Zero means idle connections are kept open indefinitely.
+	IdleTimeout time.Duration
+	// MaxLifetime closes connections once they have been open for longer than
+	// this, instead of reusing them.  Zero means connections are reused forever.
+	MaxLifetime time.Duration
+	// HealthCheck makes sure an idle connection has not been closed by the
+	// server or the network before it is reused.
+	HealthCheck bool
+}
+
+func (config PoolConfig) maxIdle() int {
+	switch {
+	case config.MaxIdle == 0:
+		return defaultMaxIdle
+	case config.MaxIdle < 0:
+		return 0
+	}
+	return config.MaxIdle
+}
+
+// PoolStats describes the state of a Session's connection pool, see
+// Session.Stats().
+type PoolStats struct {
+	// Open is the number of connections to the server, in use or idle
+	Open int
+	// Idle is the number of connections waiting in the pool
+	Idle int
+	// InUse is the number of connections running a query or held by a Rows
+	// iterator
+	InUse int
+	// Dialing is the number of connections being opened, these count as open
+	// but not as in use
+	Dialing int
+	// WaitCount is the total number of times a query had to wait for a
+	// connection because MaxOpen connections were in use
+	WaitCount int64
+	// WaitDuration is the total time queries have spent waiting for a connection
+	WaitDuration time.Duration
+}
+
+// Stats returns statistics about the session's connection pool.
+//
+// Example usage:
+//
+//  stats := sess.Stats()
+//  fmt.Println("in use:", stats.InUse, "idle:", stats.Idle)
+func (s *Session) Stats() PoolStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return PoolStats{
+		Open:         s.numOpen,
+		Idle:         len(s.idleConns),
+		InUse:        s.numOpen - len(s.idleConns) - s.numDialing,
+		Dialing:      s.numDialing,
+		WaitCount:    s.waitCount,
+		WaitDuration: s.waitDuration,
+	}
+}
+
+// expired returns true if a connection has been idle or open for too long to
+// be reused.
+func (config PoolConfig) expired(conn *connection, now time.Time) bool {
+	if config.IdleTimeout > 0 && now.Sub(conn.idleSince) > config.IdleTimeout {
+		return true
+	}
+	return config.MaxLifetime > 0 && now.Sub(conn.createdAt) > config.MaxLifetime
+}
+
+// return a connection from the free connections list if available, otherwise,
+// create a new connection
+func (s *Session) getConn(ctx context.Context) (*connection, error) {
+	s.mutex.Lock()
+	if s.pipelining && !s.closed {
+		return s.getSharedConn(ctx)
+	}
+
+	for {
+		if s.closed {
+			s.mutex.Unlock()
+			return nil, errSessionClosed
+		}
+
+		if n := len(s.idleConns); n > 0 {
+			// grab from end of slice so that underlying array does not need to be
+			// resized when appending idle connections later
+			conn := s.idleConns[n-1]
+			s.idleConns = s.idleConns[:n-1]
+			conn.idle = false
+			s.connsChanged(-1, 1, 0)
+
+			if s.pool.expired(conn, time.Now()) {
+				s.closeConnLocked(conn)
+				continue
+			}
+			if s.pool.HealthCheck {
+				s.mutex.Unlock()
+				alive := conn.alive()
+				s.mutex.Lock()
+				if !alive {
+					s.closeConnLocked(conn)
+					continue
+				}
+			}
+			s.mutex.Unlock()
+			return conn, nil
+		}
+
+		if s.pool.MaxOpen <= 0 || s.numOpen < s.pool.MaxOpen {
+			break
+		}
+
+		// every connection is in use, wait for one to be returned or closed
+		waiter := make(chan struct{}, 1)
+		s.connWaiters = append(s.connWaiters, waiter)
+		s.waitCount++
+		s.mutex.Unlock()
+
+		start := time.Now()
+		select {
+		case <-waiter:
+		case <-ctx.Done():
+		}
+
+		s.mutex.Lock()
+		s.waitDuration += time.Since(start)
+		if err := ctx.Err(); err != nil {
+			s.removeWaiterLocked(waiter)
+			s.mutex.Unlock()
+			return nil, err
+		}
+	}
+
+	// reserve a slot for the new connection before we connect, so that
+	// concurrent queries don't exceed MaxOpen
+	s.startDialLocked()
+	s.mutex.Unlock()
+
+	conn, err := s.dial(ctx)
+	s.mutex.Lock()
+	s.finishDialLocked(err)
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// startDialLocked counts a connection that is about to be opened as open.
+// s.mutex must be held.
+func (s *Session) startDialLocked() {
+	s.numOpen++
+	s.numDialing++
+	s.connsChanged(0, 0, 1)
+}
+
+// finishDialLocked is called once opening a connection has finished, if it
+// failed, the connection no longer counts as open and a query waiting for a
+// connection can open one instead.  s.mutex must be held.
+func (s *Session) finishDialLocked(err error) {
+	s.numDialing--
+	if err != nil {
+		s.numOpen--
+		s.wakeWaiterLocked()
+		s.connsChanged(0, 0, -1)
+		return
+	}
+	s.connsChanged(0, 1, -1)
+}
+
+// getSharedConn returns the multiplexed connection used when pipelining is
+// enabled, creating it if we don't have a working one.  s.mutex must be held,
+// it's released before returning.
+func (s *Session) getSharedConn(ctx context.Context) (*connection, error) {
+	for {
+		if s.closed {
+			s.mutex.Unlock()
+			return nil, errSessionClosed
+		}
+		conn := s.sharedConn
+		if conn != nil && conn.broken() == nil {
+			conn.mutex.Lock()
+			conn.refs++
+			conn.mutex.Unlock()
+			s.mutex.Unlock()
+			return conn, nil
+		}
+		if conn != nil {
+			// queries still using the broken connection close it once they're
+			// done with it
+			s.sharedConn = nil
+			if conn.users() == 0 {
+				s.closeConnLocked(conn)
+			}
+		}
+
+		dialing := s.sharedDialing
+		if dialing == nil {
+			break
+		}
+		// another query is connecting, wait for its connection instead of each
+		// making one
+		s.mutex.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		s.mutex.Lock()
+	}
+
+	dialing := make(chan struct{})
+	s.sharedDialing = dialing
+	s.startDialLocked()
+	s.mutex.Unlock()
+
+	conn, err := s.dial(ctx)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sharedDialing = nil
+	close(dialing)
+	s.finishDialLocked(err)
+	if err != nil {
+		return nil, err
+	}
+	if s.closed {
+		s.closeConnLocked(conn)
+		return nil, errSessionClosed
+	}
+	conn.startReader()
+	conn.mutex.Lock()
+	conn.refs++
+	conn.mutex.Unlock()
+	s.sharedConn = conn
+	return conn, nil
+}
+
+// return a connection to the free list, or close it if we already have enough
+func (s *Session) putConn(conn *connection) {
+	if conn.multiplexed {
+		s.releaseSharedConn(conn)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if s.closed || s.pool.expired(conn, now) {
+		s.closeConnLocked(conn)
+		return
+	}
+
+	// if a query is waiting for a connection, keep this one even if that puts us
+	// over the idle limit, the waiting query will take it right away
+	if len(s.idleConns) < s.pool.maxIdle() || len(s.connWaiters) > 0 {
+		conn.idleSince = now
+		conn.idle = true
+		s.idleConns = append(s.idleConns, conn)
+		s.connsChanged(1, -1, 0)
+		s.wakeWaiterLocked()
+		return
+	}
+
+	s.closeConnLocked(conn)
+}
+
+// discardConn closes a connection that can't be used for any more queries
+// instead of returning it to the pool.
+func (s *Session) discardConn(conn *connection) {
+	if conn.multiplexed {
+		// a multiplexed connection stays usable even if one of its queries was
+		// abandoned
+		s.releaseSharedConn(conn)
+		return
+	}
+
+	s.mutex.Lock()
+	s.closeConnLocked(conn)
+	s.mutex.Unlock()
+}
+
+// releaseSharedConn is called when a query or iterator is done with a
+// multiplexed connection.  The connection is closed once nobody is using it,
+// unless it's still the one new queries are sent on.
+func (s *Session) releaseSharedConn(conn *connection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conn.mutex.Lock()
+	conn.refs--
+	unused := conn.refs == 0
+	conn.mutex.Unlock()
+
+	if conn != s.sharedConn && unused {
+		s.closeConnLocked(conn)
+	}
+}
+
+// closeConnLocked closes a connection that belongs to this session and lets a
+// query waiting for a connection open a new one.  It is safe to call more than
+// once for the same connection.  s.mutex must be held.
+func (s *Session) closeConnLocked(conn *connection) error {
+	if conn.poolClosed {
+		return nil
+	}
+	conn.poolClosed = true
+	s.numOpen--
+	if conn.idle {
+		s.connsChanged(-1, 0, 0)
+	} else {
+		s.connsChanged(0, -1, 0)
+	}
+	s.wakeWaiterLocked()
+	return conn.Close()
+}
+
+// wakeWaiterLocked wakes up the query that has been waiting longest for a
+// connection, if any.  s.mutex must be held.
+func (s *Session) wakeWaiterLocked() {
+	if len(s.connWaiters) == 0 {
+		return
+	}
+	waiter := s.connWaiters[0]
+	s.connWaiters = s.connWaiters[1:]
+	waiter <- struct{}{}
+}
+
+// removeWaiterLocked removes a query that has given up waiting for a
+// connection.  If it was woken up in the meantime, the wake up is passed on to
+// the next query.  s.mutex must be held.
+func (s *Session) removeWaiterLocked(waiter chan struct{}) {
+	for i, w := range s.connWaiters {
+		if w == waiter {
+			s.connWaiters = append(s.connWaiters[:i], s.connWaiters[i+1:]...)
+			return
+		}
+	}
+	if len(waiter) > 0 {
+		s.wakeWaiterLocked()
+	}
+}
+
+// startCleaner starts a goroutine that closes expired idle connections, if
+// IdleTimeout or MaxLifetime is set.  s.mutex must be held.
+func (s *Session) startCleaner() {
+	interval := s.pool.IdleTimeout
+	if s.pool.MaxLifetime > 0 && (interval == 0 || s.pool.MaxLifetime < interval) {
+		interval = s.pool.MaxLifetime
+	}
+	if interval == 0 {
+		return
+	}
+	interval /= 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	stop := make(chan struct{})
+	s.stopCleaner = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.closeExpired()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// closeExpired closes any idle connections that have been idle or open for too
+// long.
+func (s *Session) closeExpired() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	idleConns := s.idleConns[:0]
+	for _, conn := range s.idleConns {
+		if s.pool.expired(conn, now) {
+			s.closeConnLocked(conn)
+		} else {
+			idleConns = append(idleConns, conn)
+		}
+	}
+	s.idleConns = idleConns
+}
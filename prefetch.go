@@ -0,0 +1,127 @@
+package rethinkgo
+
+import (
+	"context"
+)
+
+// prefetcher gets the next chunks of a stream in the background, while the
+// rows that have already arrived are being processed, see RunOpts.Prefetch.
+//
+// The prefetcher's goroutine is the only user of the iterator's connection
+// until it exits, at which point done is closed.  It exits once the stream is
+// complete, the iterator is closed, or the iterator's context is done, so an
+// iterator that's dropped without being closed holds on to the goroutine and
+// the connection until then.
+type prefetcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	chunks chan chunk
+	quit   chan struct{}
+	done   chan struct{}
+	// a chunk that was fetched after quit was closed, see stop()
+	last *chunk
+}
+
+// startPrefetch starts fetching chunks for a stream that isn't complete, up to
+// depth chunks are fetched before the iterator uses them
+func (rows *Rows) startPrefetch(depth int) {
+	ctx, cancel := context.WithCancel(rows.runContext())
+	pf := &prefetcher{
+		ctx:    ctx,
+		cancel: cancel,
+		// one more chunk waits to be sent on the channel
+		chunks: make(chan chunk, depth-1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	rows.prefetch = pf
+
+	session, conn, token, query := rows.session, rows.conn, rows.token, rows.query
+	go func() {
+		defer close(pf.done)
+		for {
+			c := fetchChunk(ctx, session, conn, token, query)
+			select {
+			case pf.chunks <- c:
+			case <-pf.quit:
+				pf.last = &c
+				return
+			case <-ctx.Done():
+				// nobody is going to use the chunk, Close() deals with it
+				pf.last = &c
+				return
+			}
+			if c.complete || c.err != nil {
+				return
+			}
+
+			select {
+			case <-pf.quit:
+				return
+			default:
+			}
+		}
+	}()
+}
+
+// next waits for the next chunk and adds it to the iterator
+func (pf *prefetcher) next(ctx context.Context, rows *Rows) error {
+	var c chunk
+	select {
+	case c = <-pf.chunks:
+	case <-pf.done:
+		// the goroutine has exited, either after sending the last chunk, or
+		// because the iterator's context is done
+		select {
+		case c = <-pf.chunks:
+		default:
+			return pf.ctx.Err()
+		}
+	case <-ctx.Done():
+		// don't make Close() wait for the chunk that's being fetched
+		pf.cancel()
+		return ctx.Err()
+	}
+
+	if c.complete || c.err != nil {
+		// that was the last chunk, the connection is ours again once the
+		// goroutine has exited
+		<-pf.done
+		rows.prefetch = nil
+	}
+	err := rows.applyChunk(pf.ctx, c)
+	if rows.prefetch == nil {
+		pf.cancel()
+	}
+	return err
+}
+
+// stop shuts down the prefetcher when the iterator is closed.  It waits for a
+// chunk that's being fetched, so that the connection can be used to send a
+// STOP query and returned to the pool, unless it turns out that the stream is
+// already complete or the connection failed.
+func (pf *prefetcher) stop(rows *Rows) {
+	rows.prefetch = nil
+	close(pf.quit)
+	<-pf.done
+	pf.cancel()
+
+	var unused []chunk
+	for len(pf.chunks) > 0 {
+		unused = append(unused, <-pf.chunks)
+	}
+	if pf.last != nil {
+		unused = append(unused, *pf.last)
+	}
+
+	for _, c := range unused {
+		if c.err != nil {
+			rows.session.hostFailed(rows.conn, c.err)
+			if abandoned(pf.ctx, c.err) || isNetworkError(c.err) {
+				rows.abandonConn()
+			}
+		} else if c.complete {
+			rows.complete = true
+		}
+	}
+}
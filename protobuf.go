@@ -6,25 +6,34 @@ package rethinkgo
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"encoding"
 	"encoding/json"
 	"fmt"
 	p "github.com/christopherhesse/rethinkgo/query_language"
 	"reflect"
 	"runtime"
+	"time"
 )
 
-// context stores some state that is required when converting Expressions to
+// buildContext stores some state that is required when converting Expressions to
 // protocol buffers, and has to be passed by value throughout.
-type context struct {
+type buildContext struct {
 	databaseName string
 	useOutdated  bool
+	runOpts      RunOpts
+	// terms records the expression each term was built from, if it's not nil,
+	// see locateError()
+	terms map[*p.Term]Exp
 }
 
 // toTerm converts an arbitrary object to a Term, within the context that toTerm
 // was called on.
-func (ctx context) toTerm(o interface{}) *p.Term {
-	e := Expr(o)
+func (ctx buildContext) toTerm(o interface{}) (term *p.Term) {
+	e := toExp(o)
 	value := e.value
+	if ctx.terms != nil {
+		defer func() { ctx.terms[term] = e }()
+	}
 
 	switch e.kind {
 	case literalKind:
@@ -152,7 +161,7 @@ func createGrouping(attribute interface{}) func(row Exp) interface{} {
 	panic("attribute is neither a string, nor []string")
 }
 
-func (ctx context) toBuiltin(kind expressionKind, operand interface{}) *p.Builtin {
+func (ctx buildContext) toBuiltin(kind expressionKind, operand interface{}) *p.Builtin {
 	var t p.Builtin_BuiltinType
 
 	switch kind {
@@ -328,7 +337,7 @@ func (ctx context) toBuiltin(kind expressionKind, operand interface{}) *p.Builti
 	}
 }
 
-func (ctx context) toComparisonBuiltin(kind expressionKind) *p.Builtin {
+func (ctx buildContext) toComparisonBuiltin(kind expressionKind) *p.Builtin {
 	var c p.Builtin_Comparison
 
 	switch kind {
@@ -361,7 +370,7 @@ func nextVariableName() string {
 	return fmt.Sprintf("arg_%v", variableNameCounter)
 }
 
-func (ctx context) compileGoFunc(f interface{}, requiredArgs int) (params []string, body *p.Term) {
+func (ctx buildContext) compileGoFunc(f interface{}, requiredArgs int) (params []string, body *p.Term) {
 	// presumably if we're here, the user has supplied a go func to be
 	// converted to an expression
 	value := reflect.ValueOf(f)
@@ -395,7 +404,7 @@ func (ctx context) compileGoFunc(f interface{}, requiredArgs int) (params []stri
 	return
 }
 
-func (ctx context) compileExpressionFunc(e Exp, requiredArgs int) (params []string, body *p.Term) {
+func (ctx buildContext) compileExpressionFunc(e Exp, requiredArgs int) (params []string, body *p.Term) {
 	// an expression that takes no args, e.g. Row.Attr("name") or
 	// possibly a Javascript function Js(`row.key`) which does take args
 	body = ctx.toTerm(e)
@@ -412,8 +421,8 @@ func (ctx context) compileExpressionFunc(e Exp, requiredArgs int) (params []stri
 	return
 }
 
-func (ctx context) compileFunction(o interface{}, requiredArgs int) ([]string, *p.Term) {
-	e := Expr(o)
+func (ctx buildContext) compileFunction(o interface{}, requiredArgs int) ([]string, *p.Term) {
+	e := toExp(o)
 
 	if e.kind == literalKind && reflect.ValueOf(e.value).Kind() == reflect.Func {
 		return ctx.compileGoFunc(e.value, requiredArgs)
@@ -422,7 +431,7 @@ func (ctx context) compileFunction(o interface{}, requiredArgs int) ([]string, *
 	return ctx.compileExpressionFunc(e, requiredArgs)
 }
 
-func (ctx context) toMapping(o interface{}) *p.Mapping {
+func (ctx buildContext) toMapping(o interface{}) *p.Mapping {
 	args, body := ctx.compileFunction(o, 1)
 
 	return &p.Mapping{
@@ -431,7 +440,7 @@ func (ctx context) toMapping(o interface{}) *p.Mapping {
 	}
 }
 
-func (ctx context) toPredicate(o interface{}) *p.Predicate {
+func (ctx buildContext) toPredicate(o interface{}) *p.Predicate {
 	args, body := ctx.compileFunction(o, 1)
 
 	return &p.Predicate{
@@ -440,7 +449,7 @@ func (ctx context) toPredicate(o interface{}) *p.Predicate {
 	}
 }
 
-func (ctx context) toReduction(o interface{}, base *p.Term) *p.Reduction {
+func (ctx buildContext) toReduction(o interface{}, base *p.Term) *p.Reduction {
 	args, body := ctx.compileFunction(o, 2)
 
 	return &p.Reduction{
@@ -451,7 +460,7 @@ func (ctx context) toReduction(o interface{}, base *p.Term) *p.Reduction {
 	}
 }
 
-func (ctx context) literalToTerm(literal interface{}) *p.Term {
+func (ctx buildContext) literalToTerm(literal interface{}) *p.Term {
 	value := reflect.ValueOf(literal)
 
 	switch value.Kind() {
@@ -468,6 +477,21 @@ func (ctx context) literalToTerm(literal interface{}) *p.Term {
 		}
 	}
 
+	// structs that don't encode themselves become objects, so that their fields
+	// can hold expressions
+	if value.IsValid() && !marshalsItself(value) {
+		structValue := value
+		if structValue.Kind() == reflect.Ptr && !structValue.IsNil() {
+			structValue = structValue.Elem()
+		}
+		if structValue.Kind() == reflect.Struct && !marshalsItself(structValue) {
+			return &p.Term{
+				Type:   p.Term_OBJECT.Enum(),
+				Object: ctx.structToVarTermTuples(structValue),
+			}
+		}
+	}
+
 	// hopefully it's JSONable
 	buf, err := json.Marshal(literal)
 	if err != nil {
@@ -480,7 +504,7 @@ func (ctx context) literalToTerm(literal interface{}) *p.Term {
 	}
 }
 
-func (ctx context) sliceToTerms(a interface{}) []*p.Term {
+func (ctx buildContext) sliceToTerms(a interface{}) []*p.Term {
 	terms := []*p.Term{}
 	for _, arg := range toArray(a) {
 		terms = append(terms, ctx.toTerm(arg))
@@ -521,7 +545,7 @@ func toObject(m interface{}) map[string]interface{} {
 	return object
 }
 
-func (ctx context) mapToPredicate(m interface{}) *p.Predicate {
+func (ctx buildContext) mapToPredicate(m interface{}) *p.Predicate {
 	expr := Expr(true)
 	// And all these terms together
 	for key, value := range toObject(m) {
@@ -531,7 +555,7 @@ func (ctx context) mapToPredicate(m interface{}) *p.Predicate {
 	return ctx.toPredicate(expr)
 }
 
-func (ctx context) mapToVarTermTuples(m interface{}) []*p.VarTermTuple {
+func (ctx buildContext) mapToVarTermTuples(m interface{}) []*p.VarTermTuple {
 	var tuples []*p.VarTermTuple
 	for key, value := range toObject(m) {
 		tuple := &p.VarTermTuple{
@@ -543,7 +567,112 @@ func (ctx context) mapToVarTermTuples(m interface{}) []*p.VarTermTuple {
 	return tuples
 }
 
-func (ctx context) toTableRef(table tableInfo) *p.TableRef {
+// structToVarTermTuples converts the fields of a struct to the attributes of
+// an object, named the same way as when decoding rows.  Fields tagged with
+// omitempty are left out if they have their zero value, as is the primary key
+// (so that the server generates one).  Fields tagged with string are sent as
+// strings, like encoding/json does.
+func (ctx buildContext) structToVarTermTuples(structValue reflect.Value) []*p.VarTermTuple {
+	var tuples []*p.VarTermTuple
+	for _, f := range cachedFields(structValue.Type()) {
+		fieldValue, ok := fieldByIndexNoAlloc(structValue, f.index)
+		if !ok || ((f.omitEmpty || f.primaryKey) && isEmptyValue(fieldValue)) {
+			continue
+		}
+		field := fieldValue.Interface()
+		switch {
+		case fieldValue.Kind() != reflect.Ptr && fieldValue.CanAddr() && marshalsItself(fieldValue):
+			// so that methods with pointer receivers are used, as encoding/json
+			// does for the fields of a struct it has a pointer to
+			field = fieldValue.Addr().Interface()
+		case f.quoted:
+			field = quotedField(fieldValue)
+		}
+		tuple := &p.VarTermTuple{
+			Var:  proto.String(f.name),
+			Term: ctx.toTerm(field),
+		}
+		tuples = append(tuples, tuple)
+	}
+	return tuples
+}
+
+// quotedField returns the value of a field tagged ",string", which is its
+// JSON as a string, or nil for a nil pointer
+func quotedField(fieldValue reflect.Value) interface{} {
+	if fieldValue.Kind() == reflect.Ptr {
+		if fieldValue.IsNil() {
+			return nil
+		}
+		fieldValue = fieldValue.Elem()
+	}
+	data, err := json.Marshal(fieldValue.Interface())
+	if err != nil {
+		// infinite or NaN, which the server rejects anyway
+		return fieldValue.Interface()
+	}
+	return string(data)
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// marshalsItself returns true if encoding/json would have a value encode
+// itself, as a json.Marshaler or an encoding.TextMarshaler, which includes
+// methods with pointer receivers if the value is addressable
+func marshalsItself(v reflect.Value) bool {
+	t := v.Type()
+	if t.Implements(marshalerType) || t.Implements(textMarshalerType) {
+		return true
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		t = reflect.PointerTo(t)
+		return t.Implements(marshalerType) || t.Implements(textMarshalerType)
+	}
+	return false
+}
+
+// fieldByIndexNoAlloc returns a nested field of a struct, or false if it's
+// inside an embedded struct pointer that is nil.
+func fieldByIndexNoAlloc(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmptyValue is the same test that encoding/json uses for omitempty, except
+// that an unset Exp is also empty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	if e, ok := v.Interface().(Exp); ok {
+		return e.kind == literalKind && e.value == nil
+	}
+	return false
+}
+
+func (ctx buildContext) toTableRef(table tableInfo) *p.TableRef {
 	// Use the context's database name if we didn't specify one
 	databaseName := table.database.name
 	if databaseName == "" {
@@ -557,17 +686,31 @@ func (ctx context) toTableRef(table tableInfo) *p.TableRef {
 }
 
 // toProtobuf converts a bare Exp directly to a read query protobuf
-func (e Exp) toProtobuf(ctx context) *p.Query {
+func (e Exp) toProtobuf(ctx buildContext) *p.Query {
+	readQueryProto := &p.ReadQuery{
+		Term: ctx.toTerm(e),
+	}
+
+	switch chunkSize := ctx.runOpts.ChunkSize; {
+	case chunkSize < 0:
+		// the server treats 0 as unlimited
+		readQueryProto.MaxChunkSize = proto.Int64(0)
+	case chunkSize > 0:
+		readQueryProto.MaxChunkSize = proto.Int64(int64(chunkSize))
+	}
+	if maxAge := ctx.runOpts.MaxAge; maxAge > 0 {
+		// round up, so a short max age isn't sent as 0
+		readQueryProto.MaxAge = proto.Int64(int64((maxAge + time.Second - 1) / time.Second))
+	}
+
 	return &p.Query{
-		Type: p.Query_READ.Enum(),
-		ReadQuery: &p.ReadQuery{
-			Term: ctx.toTerm(e),
-		},
+		Type:      p.Query_READ.Enum(),
+		ReadQuery: readQueryProto,
 	}
 }
 
 // toProtobuf converts a complete query to a protobuf
-func (q MetaQuery) toProtobuf(ctx context) *p.Query {
+func (q MetaQuery) toProtobuf(ctx buildContext) *p.Query {
 	var metaQueryProto *p.MetaQuery
 
 	switch v := q.query.(type) {
@@ -627,7 +770,7 @@ func (q MetaQuery) toProtobuf(ctx context) *p.Query {
 	}
 }
 
-func (q WriteQuery) toProtobuf(ctx context) *p.Query {
+func (q WriteQuery) toProtobuf(ctx buildContext) *p.Query {
 	var writeQueryProto *p.WriteQuery
 
 	switch v := q.query.(type) {
@@ -753,7 +896,7 @@ func (q WriteQuery) toProtobuf(ctx context) *p.Query {
 
 // buildProtobuf converts a query to a protobuf and catches any panics raised
 // by the toProtobuf() functions.
-func (ctx context) buildProtobuf(query Query) (queryProto *p.Query, err error) {
+func (ctx buildContext) buildProtobuf(query Query) (queryProto *p.Query, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if _, ok := r.(runtime.Error); ok {
@@ -770,16 +913,16 @@ func (ctx context) buildProtobuf(query Query) (queryProto *p.Query, err error) {
 // Check compiles a query for sending to the server, but does not send it.
 // There is one .Check() method for each query type.
 func (e Exp) Check(s *Session) error {
-	_, err := s.getContext().buildProtobuf(e)
+	_, err := s.getBuildContext().buildProtobuf(e)
 	return err
 }
 
 func (q MetaQuery) Check(s *Session) error {
-	_, err := s.getContext().buildProtobuf(q)
+	_, err := s.getBuildContext().buildProtobuf(q)
 	return err
 }
 
 func (q WriteQuery) Check(s *Session) error {
-	_, err := s.getContext().buildProtobuf(q)
+	_, err := s.getBuildContext().buildProtobuf(q)
 	return err
 }
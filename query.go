@@ -127,6 +127,8 @@ const (
 type Exp struct { // this would be Expr, but then it would conflict with the function that creates Exp instances
 	value interface{}
 	kind  expressionKind
+	// site is where the expression was built, see SetDebugCallSites()
+	site string
 }
 
 // WriteQuery is the type returned by any method that writes to a table, this
@@ -134,9 +136,10 @@ type Exp struct { // this would be Expr, but then it would conflict with the fun
 // message returned by the server for these queries can be read into the
 // r.WriteResponse struct.
 type WriteQuery struct {
-	query     interface{}
-	nonatomic bool
-	overwrite bool // for insert query
+	query      interface{}
+	nonatomic  bool
+	overwrite  bool // for insert query
+	idempotent bool // safe to retry, see RetryPolicy
 }
 
 // MetaQuery is the type returned by methods that create/modify/delete
@@ -174,6 +177,20 @@ var Row = Exp{kind: implicitVariableKind}
 // by that module can be used. If the value cannot be converted, an error is
 // returned at query .Run(session) time.
 //
+// Structs are converted field by field into objects, so fields can hold
+// expressions as well as values, unless they encode themselves by implementing
+// json.Marshaler or encoding.TextMarshaler, which is used wherever
+// encoding/json would use it.  Fields are named using a `rethinkdb` tag, then
+// a `json` tag, and support the "omitempty" option.  A field tagged
+// "primarykey" is left out when it has its zero value, so that the server
+// generates a key when the struct is inserted:
+//
+//  type Hero struct {
+//      Id    string `rethinkdb:"id,primarykey"`
+//      Name  string `rethinkdb:"name"`
+//      Count r.Exp  `rethinkdb:"count,omitempty"`
+//  }
+//
 // If you want to call expression methods on an object that is not yet an
 // expression, this is the function you want.
 //
@@ -188,16 +205,25 @@ var Row = Exp{kind: implicitVariableKind}
 func Expr(values ...interface{}) Exp {
 	switch len(values) {
 	case 0:
-		return Exp{kind: literalKind, value: nil}
+		return withCallSite(Exp{kind: literalKind, value: nil})
 	case 1:
 		value := values[0]
 		v, ok := value.(Exp)
 		if ok {
 			return v
 		}
-		return Exp{kind: literalKind, value: value}
+		return withCallSite(Exp{kind: literalKind, value: value})
 	}
-	return Exp{kind: literalKind, value: values}
+	return withCallSite(Exp{kind: literalKind, value: values})
+}
+
+// toExp is Expr() for a single value, for use while building a query, so that
+// no call site is recorded for it
+func toExp(value interface{}) Exp {
+	if e, ok := value.(Exp); ok {
+		return e
+	}
+	return Exp{kind: literalKind, value: value}
 }
 
 ///////////
@@ -286,7 +312,7 @@ func Expr(values ...interface{}) Exp {
 //    ...
 //   ]
 func Js(body string) Exp {
-	return Exp{kind: javascriptKind, value: body}
+	return withCallSite(Exp{kind: javascriptKind, value: body})
 }
 
 type letArgs struct {
@@ -324,13 +350,13 @@ func Let(binds Map, expr interface{}) Exp {
 		binds: binds,
 		expr:  expr,
 	}
-	return Exp{kind: letKind, value: value}
+	return withCallSite(Exp{kind: letKind, value: value})
 }
 
 // LetVar lets you reference a variable bound in the current context (for
 // example, with Let()).  See the Let example for how to use LetVar.
 func LetVar(name string) Exp {
-	return Exp{kind: variableKind, value: name}
+	return withCallSite(Exp{kind: variableKind, value: name})
 }
 
 // RuntimeError tells the server to respond with a ErrRuntime, useful for
@@ -340,7 +366,7 @@ func LetVar(name string) Exp {
 //
 //  err := r.RuntimeError("hi there").Run(session).Err()
 func RuntimeError(message string) Exp {
-	return Exp{kind: errorKind, value: message}
+	return withCallSite(Exp{kind: errorKind, value: message})
 }
 
 type ifArgs struct {
@@ -364,7 +390,7 @@ func Branch(test, trueBranch, falseBranch interface{}) Exp {
 		trueBranch:  trueBranch,
 		falseBranch: falseBranch,
 	}
-	return Exp{kind: ifKind, value: value}
+	return withCallSite(Exp{kind: ifKind, value: value})
 }
 
 type getArgs struct {
@@ -396,7 +422,7 @@ type getArgs struct {
 //  }
 func (e Exp) Get(key interface{}, attribute string) Exp {
 	value := getArgs{table: e, key: Expr(key), attribute: attribute}
-	return Exp{kind: getByKeyKind, value: value}
+	return withCallSite(Exp{kind: getByKeyKind, value: value})
 }
 
 // GetById is the same as Get with "id" used as the attribute
@@ -508,7 +534,7 @@ type useOutdatedArgs struct {
 //  rows := r.Table("heroes").Filter(compareFunc).UseOutdated(true).Run(session)
 func (e Exp) UseOutdated(useOutdated bool) Exp {
 	value := useOutdatedArgs{expr: e, useOutdated: useOutdated}
-	return Exp{kind: useOutdatedKind, value: value}
+	return withCallSite(Exp{kind: useOutdatedKind, value: value})
 }
 
 //////////////
@@ -521,10 +547,10 @@ type builtinArgs struct {
 }
 
 func naryBuiltin(kind expressionKind, operand interface{}, args ...interface{}) Exp {
-	return Exp{
+	return withCallSite(Exp{
 		kind:  kind,
 		value: builtinArgs{operand: operand, args: args},
-	}
+	})
 }
 
 // Attr gets an attribute's value from the row.
@@ -1837,12 +1863,12 @@ type tableInfo struct {
 //  ]
 func Table(name string) Exp {
 	value := tableInfo{name: name}
-	return Exp{kind: tableKind, value: value}
+	return withCallSite(Exp{kind: tableKind, value: value})
 }
 
 func (db database) Table(name string) Exp {
 	value := tableInfo{name: name, database: db}
-	return Exp{kind: tableKind, value: value}
+	return withCallSite(Exp{kind: tableKind, value: value})
 }
 
 type insertQuery struct {
@@ -1859,6 +1885,14 @@ type insertQuery struct {
 //  var response r.WriteResponse
 //  row := r.Map{"name": "Thing"}
 //  err := r.Table("heroes").Insert(row).Run(session).One(&response)
+//
+// Example with a struct (see Expr for the supported tags):
+//
+//  type Hero struct {
+//      Id   string `rethinkdb:"id,primarykey"`
+//      Name string `rethinkdb:"name"`
+//  }
+//  err := r.Table("heroes").Insert(Hero{Name: "Thing"}).Run(session).One(&response)
 func (e Exp) Insert(rows ...interface{}) WriteQuery {
 	// Assume the expression is a table for now, we'll check later in buildProtobuf
 	return WriteQuery{query: insertQuery{
@@ -1916,6 +1950,14 @@ type updateQuery struct {
 //  err := r.Table("heroes").GetById(id).Update(replacement).Run(session).One(&response)
 //  // Update all rows in the database
 //  err := r.Table("heroes").Update(replacement).Run(session).One(&response)
+//
+// Example with a struct whose fields are expressions:
+//
+//  type Patch struct {
+//      Count r.Exp `rethinkdb:"count"`
+//  }
+//  patch := Patch{Count: r.Row.Attr("count").Add(1)}
+//  err := r.Table("heroes").Update(patch).Run(session).One(&response)
 func (e Exp) Update(mapping interface{}) WriteQuery {
 	return WriteQuery{query: updateQuery{
 		view:    e,
@@ -1,5 +1,12 @@
 package rethinkgo
 
+import (
+	"encoding/json"
+	"fmt"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"runtime"
+)
+
 // WriteResponse is a type that can be used to read responses to write queries, such as .Insert()
 //
 // Example usage:
@@ -17,3 +24,140 @@ type WriteResponse struct {
 	GeneratedKeys []string `json:"generated_keys"`
 	FirstError    string   `json:"first_error"` // populated if Errors > 0
 }
+
+// SetStrictWrites causes .One(&response) to return a WriteError when response
+// is a *WriteResponse that reports errors, so that rows failing to be written
+// can't go unnoticed.  Otherwise a write query only fails if the whole query
+// fails, and the errors are only counted in the response.
+//
+// Example usage:
+//
+//  session.SetStrictWrites(true)
+//  var response r.WriteResponse
+//  err := r.Table("heroes").Insert(heroes).Run(session).One(&response)
+//  // err is a WriteError if any of the heroes already exists
+func (s *Session) SetStrictWrites(strict bool) {
+	s.strictWrites = strict
+}
+
+// Add adds the counts of another response to this one, for instance to total
+// up the responses to several inserts into the same table.  GeneratedKeys are
+// appended in order and FirstError is kept if it's already set.
+//
+// Example usage:
+//
+//  var total r.WriteResponse
+//  for _, batch := range batches {
+//      response, err := r.RunWrite(r.Table("heroes").Insert(batch...), session)
+//      ...
+//      total.Add(response)
+//  }
+func (r *WriteResponse) Add(other WriteResponse) {
+	r.Inserted += other.Inserted
+	r.Errors += other.Errors
+	r.Updated += other.Updated
+	r.Skipped += other.Skipped
+	r.Modified += other.Modified
+	r.Deleted += other.Deleted
+	r.GeneratedKeys = append(r.GeneratedKeys, other.GeneratedKeys...)
+	if r.FirstError == "" {
+		r.FirstError = other.FirstError
+	}
+}
+
+// Err returns a WriteError if some rows failed to be written, or nil.
+//
+// Example usage:
+//
+//  var response r.WriteResponse
+//  err := r.Table("heroes").Insert(heroes).Run(session).One(&response)
+//  if err == nil {
+//      err = response.Err()
+//  }
+func (r WriteResponse) Err() error {
+	if r.Errors > 0 {
+		return WriteError{Response: r}
+	}
+	return nil
+}
+
+// GeneratedKeysByRow matches GeneratedKeys with the rows that were inserted,
+// which must be passed exactly as they were passed to Insert().  The server
+// generates a key for each row that has no primary key attribute, the result
+// has the generated key of each row at the row's position, or "" for rows that
+// had their own key.  If rows is a single list, the positions are those of the
+// rows in the list.
+//
+// An error is returned if the number of rows without a primary key doesn't
+// match the number of generated keys, for instance because some of the rows
+// failed to be inserted.
+//
+// Example usage:
+//
+//  heroes := []interface{}{r.Map{"name": "Storm"}, r.Map{"id": "logan", "name": "Wolverine"}}
+//  response, err := r.RunWrite(r.Table("heroes").Insert(heroes...), session)
+//  keys, err := response.GeneratedKeysByRow("id", heroes...)
+//  fmt.Println("Storm's key is", keys[0])
+func (r WriteResponse) GeneratedKeysByRow(primaryKey string, rows ...interface{}) (keys []string, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(runtime.Error); ok {
+				panic(e)
+			}
+			err = fmt.Errorf("rethinkdb: %v", e)
+		}
+	}()
+
+	ctx := buildContext{}
+	var terms []*p.Term
+	for _, row := range rows {
+		terms = append(terms, ctx.toTerm(row))
+	}
+	if len(terms) == 1 && terms[0].GetType() == p.Term_ARRAY {
+		// Insert() does the same with a single list
+		terms = terms[0].Array
+	}
+
+	var missing []int
+	for i, term := range terms {
+		hasKey, ok := hasAttribute(term, primaryKey)
+		if !ok {
+			return nil, fmt.Errorf("rethinkdb: Can't tell whether row %v has a primary key", i)
+		}
+		if !hasKey {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) != len(r.GeneratedKeys) {
+		return nil, fmt.Errorf("rethinkdb: %v rows have no primary key, but %v keys were generated", len(missing), len(r.GeneratedKeys))
+	}
+
+	keys = make([]string, len(terms))
+	for i, position := range missing {
+		keys[position] = r.GeneratedKeys[i]
+	}
+	return keys, nil
+}
+
+// hasAttribute says whether the object a term evaluates to has an attribute,
+// ok is false if that can't be known without running the term
+func hasAttribute(term *p.Term, name string) (hasAttr, ok bool) {
+	switch term.GetType() {
+	case p.Term_OBJECT:
+		for _, tuple := range term.Object {
+			if tuple.GetVar() == name {
+				return true, true
+			}
+		}
+		return false, true
+
+	case p.Term_JSON:
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(term.GetJsonstring()), &object); err != nil {
+			return false, false
+		}
+		_, hasAttr = object[name]
+		return hasAttr, true
+	}
+	return false, false
+}
@@ -0,0 +1,675 @@
+package rethinkgotest
+
+// Evaluate query terms against the tables of a DB.
+// Functions in this file panic with a queryError on failure, the caller is
+// expected to recover().
+
+import (
+	"encoding/json"
+	"fmt"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Values are what encoding/json produces when decoding into an interface{}:
+// nil, bool, float64, string, []interface{} and map[string]interface{}.  Values
+// are never modified once created, so they can be shared between tables and
+// results.  Sequences read from a table are streams instead of arrays, as on
+// the server.
+type stream []interface{}
+
+// queryError is an error caused by running a query, it becomes a RUNTIME_ERROR
+// or, if bad is set, a BAD_QUERY response.
+type queryError struct {
+	message string
+	bad     bool
+}
+
+func (e queryError) Error() string {
+	return e.message
+}
+
+func runtimeError(format string, args ...interface{}) {
+	panic(queryError{message: fmt.Sprintf(format, args...)})
+}
+
+func badQuery(format string, args ...interface{}) {
+	panic(queryError{message: fmt.Sprintf(format, args...), bad: true})
+}
+
+// scope holds the variables visible to a term.  Mappings and predicates also
+// set the implicit variable, r.Row in the driver.
+type scope struct {
+	name     string
+	value    interface{}
+	implicit bool
+	parent   *scope
+}
+
+func (sc *scope) bind(name string, value interface{}) *scope {
+	return &scope{name: name, value: value, parent: sc}
+}
+
+func (sc *scope) bindRow(name string, row interface{}) *scope {
+	return &scope{value: row, implicit: true, parent: sc.bind(name, row)}
+}
+
+func (sc *scope) lookup(name string) interface{} {
+	for s := sc; s != nil; s = s.parent {
+		if !s.implicit && s.name == name {
+			return s.value
+		}
+	}
+	runtimeError("Symbol '%v' is not in scope.", name)
+	return nil
+}
+
+func (sc *scope) implicitRow() interface{} {
+	for s := sc; s != nil; s = s.parent {
+		if s.implicit {
+			return s.value
+		}
+	}
+	runtimeError("No implicit variable in scope.")
+	return nil
+}
+
+// evaluator runs terms, the DB must be locked while it's in use.
+type evaluator struct {
+	db *DB
+}
+
+func (ev evaluator) eval(term *p.Term, sc *scope) interface{} {
+	switch term.GetType() {
+	case p.Term_JSON_NULL:
+		return nil
+	case p.Term_VAR:
+		return sc.lookup(term.GetVar())
+	case p.Term_IMPLICIT_VAR:
+		return sc.implicitRow()
+	case p.Term_LET:
+		for _, bind := range term.GetLet().Binds {
+			sc = sc.bind(bind.GetVar(), ev.eval(bind.Term, sc))
+		}
+		return ev.eval(term.GetLet().GetExpr(), sc)
+	case p.Term_CALL:
+		return ev.call(term.GetCall().GetBuiltin(), term.GetCall().Args, sc)
+	case p.Term_IF:
+		branch := term.GetIf_()
+		if toBool(ev.eval(branch.GetTest(), sc)) {
+			return ev.eval(branch.GetTrueBranch(), sc)
+		}
+		return ev.eval(branch.GetFalseBranch(), sc)
+	case p.Term_ERROR:
+		runtimeError("%v", term.GetError())
+	case p.Term_NUMBER:
+		return term.GetNumber()
+	case p.Term_STRING:
+		return term.GetValuestring()
+	case p.Term_BOOL:
+		return term.GetValuebool()
+	case p.Term_JSON:
+		var value interface{}
+		if err := json.Unmarshal([]byte(term.GetJsonstring()), &value); err != nil {
+			badQuery("Invalid JSON: %v", err)
+		}
+		return value
+	case p.Term_ARRAY:
+		array := []interface{}{}
+		for _, element := range term.Array {
+			array = append(array, datum(ev.eval(element, sc)))
+		}
+		return array
+	case p.Term_OBJECT:
+		object := map[string]interface{}{}
+		for _, tuple := range term.Object {
+			object[tuple.GetVar()] = datum(ev.eval(tuple.Term, sc))
+		}
+		return object
+	case p.Term_GETBYKEY:
+		getByKey := term.GetGetByKey()
+		t := ev.db.table(getByKey.GetTableRef())
+		if getByKey.GetAttrname() != t.primaryKey {
+			runtimeError("Attribute: %v is not the primary key (%v) and thus cannot be selected upon.", getByKey.GetAttrname(), t.primaryKey)
+		}
+		return t.get(ev.eval(getByKey.GetKey(), sc))
+	case p.Term_TABLE:
+		return ev.db.table(term.GetTable().GetTableRef()).scan()
+	case p.Term_JAVASCRIPT:
+		runtimeError("rethinkgotest: Javascript is not supported: %v", term.GetJavascript())
+	}
+	badQuery("Unknown term type: %v", term.GetType())
+	return nil
+}
+
+// call runs a builtin on its arguments.
+func (ev evaluator) call(builtin *p.Builtin, argTerms []*p.Term, sc *scope) interface{} {
+	// ANY and ALL stop at the first argument that decides the result
+	switch builtin.GetType() {
+	case p.Builtin_ANY, p.Builtin_ALL:
+		all := builtin.GetType() == p.Builtin_ALL
+		for _, arg := range argTerms {
+			if toBool(ev.eval(arg, sc)) != all {
+				return !all
+			}
+		}
+		return all
+	}
+
+	var args []interface{}
+	for _, arg := range argTerms {
+		args = append(args, ev.eval(arg, sc))
+	}
+	arg := func(i int) interface{} {
+		if i >= len(args) {
+			badQuery("%v expects at least %v arguments.", builtin.GetType(), i+1)
+		}
+		return args[i]
+	}
+
+	switch builtin.GetType() {
+	case p.Builtin_NOT:
+		return !toBool(arg(0))
+	case p.Builtin_GETATTR:
+		return getAttr(arg(0), builtin.GetAttr())
+	case p.Builtin_IMPLICIT_GETATTR:
+		return getAttr(sc.implicitRow(), builtin.GetAttr())
+	case p.Builtin_HASATTR:
+		_, ok := toObject(arg(0))[builtin.GetAttr()]
+		return ok
+	case p.Builtin_IMPLICIT_HASATTR:
+		_, ok := toObject(sc.implicitRow())[builtin.GetAttr()]
+		return ok
+	case p.Builtin_PICKATTRS:
+		return pick(arg(0), builtin.Attrs)
+	case p.Builtin_IMPLICIT_PICKATTRS:
+		return pick(sc.implicitRow(), builtin.Attrs)
+	case p.Builtin_WITHOUT:
+		return without(arg(0), builtin.Attrs)
+	case p.Builtin_IMPLICIT_WITHOUT:
+		return without(sc.implicitRow(), builtin.Attrs)
+	case p.Builtin_MAPMERGE:
+		merged := map[string]interface{}{}
+		for _, object := range args {
+			for key, value := range toObject(object) {
+				merged[key] = value
+			}
+		}
+		return merged
+	case p.Builtin_ARRAYAPPEND:
+		array := toArray(arg(0))
+		return append(append([]interface{}{}, array...), datum(arg(1)))
+	case p.Builtin_SLICE:
+		items, isStream := toSequence(arg(0))
+		lower, upper := 0, len(items)
+		if arg(1) != nil {
+			lower = sliceIndex(arg(1), len(items))
+		}
+		if len(args) > 2 && args[2] != nil {
+			upper = sliceIndex(args[2], len(items))
+		}
+		if upper < lower {
+			upper = lower
+		}
+		return sequence(items[lower:upper], isStream)
+	case p.Builtin_ADD, p.Builtin_SUBTRACT, p.Builtin_MULTIPLY, p.Builtin_DIVIDE, p.Builtin_MODULO:
+		return arithmetic(builtin.GetType(), args)
+	case p.Builtin_COMPARE:
+		return comparison(builtin.GetComparison(), args)
+	case p.Builtin_FILTER:
+		predicate := builtin.GetFilter().GetPredicate()
+		items, isStream := toSequence(arg(0))
+		filtered := []interface{}{}
+		for _, row := range items {
+			if toBool(ev.eval(predicate.GetBody(), sc.bindRow(predicate.GetArg(), row))) {
+				filtered = append(filtered, row)
+			}
+		}
+		return sequence(filtered, isStream)
+	case p.Builtin_MAP:
+		items, isStream := toSequence(arg(0))
+		mapped := []interface{}{}
+		for _, row := range items {
+			mapped = append(mapped, datum(ev.apply(builtin.GetMap().GetMapping(), row, sc)))
+		}
+		return sequence(mapped, isStream)
+	case p.Builtin_CONCATMAP:
+		items, isStream := toSequence(arg(0))
+		mapped := []interface{}{}
+		for _, row := range items {
+			results, _ := toSequence(ev.apply(builtin.GetConcatMap().GetMapping(), row, sc))
+			mapped = append(mapped, results...)
+		}
+		return sequence(mapped, isStream)
+	case p.Builtin_ORDERBY:
+		items, isStream := toSequence(arg(0))
+		return sequence(orderBy(items, builtin.OrderBy), isStream)
+	case p.Builtin_DISTINCT:
+		items, isStream := toSequence(arg(0))
+		var distinct []interface{}
+		for _, item := range items {
+			if indexOf(distinct, item) < 0 {
+				distinct = append(distinct, item)
+			}
+		}
+		return sequence(distinct, isStream)
+	case p.Builtin_LENGTH:
+		items, _ := toSequence(arg(0))
+		return float64(len(items))
+	case p.Builtin_UNION:
+		union := []interface{}{}
+		anyStream := false
+		for _, arg := range args {
+			items, isStream := toSequence(arg)
+			union = append(union, items...)
+			anyStream = anyStream || isStream
+		}
+		return sequence(union, anyStream)
+	case p.Builtin_NTH:
+		items, _ := toSequence(arg(0))
+		i := toInt(arg(1))
+		if i < 0 || i >= len(items) {
+			runtimeError("Index out of bounds.")
+		}
+		return items[i]
+	case p.Builtin_STREAMTOARRAY:
+		items, _ := toSequence(arg(0))
+		return []interface{}(items)
+	case p.Builtin_ARRAYTOSTREAM:
+		return stream(toArray(arg(0)))
+	case p.Builtin_REDUCE:
+		items, _ := toSequence(arg(0))
+		return ev.reduce(builtin.GetReduce(), items, sc)
+	case p.Builtin_GROUPEDMAPREDUCE:
+		items, _ := toSequence(arg(0))
+		return ev.groupedMapReduce(builtin.GetGroupedMapReduce(), items, sc)
+	case p.Builtin_RANGE:
+		items, isStream := toSequence(arg(0))
+		r := builtin.GetRange()
+		lower := ev.eval(r.GetLowerbound(), sc)
+		upper := ev.eval(r.GetUpperbound(), sc)
+		var inRange []interface{}
+		for _, row := range items {
+			value, ok := toObject(row)[r.GetAttrname()]
+			if !ok {
+				continue
+			}
+			if (lower == nil || compare(value, lower) >= 0) && (upper == nil || compare(value, upper) <= 0) {
+				inRange = append(inRange, row)
+			}
+		}
+		return sequence(inRange, isStream)
+	}
+	badQuery("Unknown builtin type: %v", builtin.GetType())
+	return nil
+}
+
+// apply runs a mapping on a row.
+func (ev evaluator) apply(mapping *p.Mapping, row interface{}, sc *scope) interface{} {
+	return ev.eval(mapping.GetBody(), sc.bindRow(mapping.GetArg(), row))
+}
+
+func (ev evaluator) reduce(reduction *p.Reduction, items []interface{}, sc *scope) interface{} {
+	acc := ev.eval(reduction.GetBase(), sc)
+	for _, item := range items {
+		acc = ev.eval(reduction.GetBody(), sc.bind(reduction.GetVar1(), acc).bind(reduction.GetVar2(), item))
+	}
+	return acc
+}
+
+func (ev evaluator) groupedMapReduce(gmr *p.Builtin_GroupedMapReduce, items []interface{}, sc *scope) interface{} {
+	var groups []interface{}
+	var values [][]interface{}
+	for _, row := range items {
+		group := datum(ev.apply(gmr.GetGroupMapping(), row, sc))
+		value := datum(ev.apply(gmr.GetValueMapping(), row, sc))
+		i := indexOf(groups, group)
+		if i < 0 {
+			i = len(groups)
+			groups = append(groups, group)
+			values = append(values, nil)
+		}
+		values[i] = append(values[i], value)
+	}
+
+	result := []interface{}{}
+	for i, group := range groups {
+		result = append(result, map[string]interface{}{
+			"group":     group,
+			"reduction": ev.reduce(gmr.GetReduction(), values[i], sc),
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return compare(result[i].(map[string]interface{})["group"], result[j].(map[string]interface{})["group"]) < 0
+	})
+	return result
+}
+
+func orderBy(items []interface{}, orderings []*p.Builtin_OrderBy) []interface{} {
+	for _, item := range items {
+		object := toObject(item)
+		for _, ordering := range orderings {
+			if _, ok := object[ordering.GetAttr()]; !ok {
+				runtimeError("ORDERBY encountered a row missing attr '%v'", ordering.GetAttr())
+			}
+		}
+	}
+
+	sorted := append([]interface{}{}, items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		left, right := sorted[i].(map[string]interface{}), sorted[j].(map[string]interface{})
+		for _, ordering := range orderings {
+			c := compare(left[ordering.GetAttr()], right[ordering.GetAttr()])
+			if c == 0 {
+				continue
+			}
+			return (c < 0) == ordering.GetAscending()
+		}
+		return false
+	})
+	return sorted
+}
+
+func arithmetic(op p.Builtin_BuiltinType, args []interface{}) interface{} {
+	if len(args) == 0 {
+		badQuery("%v expects at least 1 argument.", op)
+	}
+
+	// adding arrays concatenates them
+	if _, ok := args[0].([]interface{}); ok && op == p.Builtin_ADD {
+		sum := []interface{}{}
+		for _, arg := range args {
+			sum = append(sum, toArray(arg)...)
+		}
+		return sum
+	}
+
+	result := toNumber(args[0])
+	for _, arg := range args[1:] {
+		n := toNumber(arg)
+		switch op {
+		case p.Builtin_ADD:
+			result += n
+		case p.Builtin_SUBTRACT:
+			result -= n
+		case p.Builtin_MULTIPLY:
+			result *= n
+		case p.Builtin_DIVIDE:
+			if n == 0 {
+				runtimeError("Cannot divide by zero.")
+			}
+			result /= n
+		case p.Builtin_MODULO:
+			if n == 0 {
+				runtimeError("Cannot take a number modulo 0.")
+			}
+			result = float64(toInt(result) % toInt(n))
+		}
+	}
+	return result
+}
+
+func comparison(op p.Builtin_Comparison, args []interface{}) bool {
+	for i := 1; i < len(args); i++ {
+		c := compare(args[i-1], args[i])
+		var ok bool
+		switch op {
+		case p.Builtin_EQ:
+			ok = c == 0
+		case p.Builtin_NE:
+			ok = c != 0
+		case p.Builtin_LT:
+			ok = c < 0
+		case p.Builtin_LE:
+			ok = c <= 0
+		case p.Builtin_GT:
+			ok = c > 0
+		case p.Builtin_GE:
+			ok = c >= 0
+		default:
+			badQuery("Unknown comparison: %v", op)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// typeName names the type of a value the way the server does in errors, the
+// names also give the order of values of different types.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		return "BOOL"
+	case float64:
+		return "NUMBER"
+	case string:
+		return "STRING"
+	case []interface{}:
+		return "ARRAY"
+	case stream:
+		return "STREAM"
+	case map[string]interface{}:
+		return "OBJECT"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// compare orders two values, values of different types are ordered by the
+// name of their type.
+func compare(a, b interface{}) int {
+	a, b = datum(a), datum(b)
+	if typeA, typeB := typeName(a), typeName(b); typeA != typeB {
+		return strings.Compare(typeA, typeB)
+	}
+
+	switch a := a.(type) {
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	case float64:
+		switch b := b.(float64); {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	case map[string]interface{}:
+		b := b.(map[string]interface{})
+		keysA, keysB := sortedKeys(a), sortedKeys(b)
+		if c := compare(keysA, keysB); c != 0 {
+			return c
+		}
+		for _, key := range keysA {
+			if c := compare(a[key.(string)], b[key.(string)]); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+func sortedKeys(object map[string]interface{}) []interface{} {
+	var keys []string
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := []interface{}{}
+	for _, key := range keys {
+		result = append(result, key)
+	}
+	return result
+}
+
+func indexOf(items []interface{}, value interface{}) int {
+	for i, item := range items {
+		if compare(item, value) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func getAttr(value interface{}, attr string) interface{} {
+	result, ok := toObject(value)[attr]
+	if !ok {
+		runtimeError("Object:\n%v\nis missing attribute \"%v\".", toJSON(value), attr)
+	}
+	return result
+}
+
+func pick(value interface{}, attrs []string) interface{} {
+	object := toObject(value)
+	picked := map[string]interface{}{}
+	for _, attr := range attrs {
+		if v, ok := object[attr]; ok {
+			picked[attr] = v
+		}
+	}
+	return picked
+}
+
+func without(value interface{}, attrs []string) interface{} {
+	result := map[string]interface{}{}
+	for key, v := range toObject(value) {
+		result[key] = v
+	}
+	for _, attr := range attrs {
+		delete(result, attr)
+	}
+	return result
+}
+
+// datum turns a stream into an array, streams can't be stored in arrays or
+// objects.
+func datum(value interface{}) interface{} {
+	if s, ok := value.(stream); ok {
+		return []interface{}(s)
+	}
+	return value
+}
+
+// sequence returns items as a stream or an array.
+func sequence(items []interface{}, isStream bool) interface{} {
+	if items == nil {
+		items = []interface{}{}
+	}
+	if isStream {
+		return stream(items)
+	}
+	return items
+}
+
+func toSequence(value interface{}) (items []interface{}, isStream bool) {
+	switch v := value.(type) {
+	case stream:
+		return v, true
+	case []interface{}:
+		return v, false
+	}
+	runtimeError("Expected a sequence but found %v: %v", typeName(value), toJSON(value))
+	return nil, false
+}
+
+func toArray(value interface{}) []interface{} {
+	array, ok := value.([]interface{})
+	if !ok {
+		runtimeError("Expected an ARRAY but found %v: %v", typeName(value), toJSON(value))
+	}
+	return array
+}
+
+func toObject(value interface{}) map[string]interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		runtimeError("Expected an OBJECT but found %v: %v", typeName(value), toJSON(value))
+	}
+	return object
+}
+
+func toBool(value interface{}) bool {
+	b, ok := value.(bool)
+	if !ok {
+		runtimeError("Expected a BOOL but found %v: %v", typeName(value), toJSON(value))
+	}
+	return b
+}
+
+func toNumber(value interface{}) float64 {
+	n, ok := value.(float64)
+	if !ok {
+		runtimeError("Expected a NUMBER but found %v: %v", typeName(value), toJSON(value))
+	}
+	return n
+}
+
+func toInt(value interface{}) int {
+	n := toNumber(value)
+	if n != math.Trunc(n) {
+		runtimeError("Expected an integer but found %v.", n)
+	}
+	return int(n)
+}
+
+// sliceIndex converts a slice bound, negative bounds count from the end.
+func sliceIndex(value interface{}, length int) int {
+	i := toInt(value)
+	if i < 0 {
+		i += length
+	}
+	if i < 0 {
+		i = 0
+	}
+	if i > length {
+		i = length
+	}
+	return i
+}
+
+func toJSON(value interface{}) string {
+	data, err := json.Marshal(datum(value))
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// deterministic returns false if a mapping could give a different result when
+// run again, because it reads a table or runs Javascript.  The server refuses
+// to run those atomically.
+func deterministic(mapping *p.Mapping) bool {
+	result := true
+	walkMessage(reflect.ValueOf(mapping), func(message interface{}) {
+		if term, ok := message.(*p.Term); ok {
+			switch term.GetType() {
+			case p.Term_TABLE, p.Term_GETBYKEY, p.Term_JAVASCRIPT:
+				result = false
+			}
+		}
+	})
+	return result
+}
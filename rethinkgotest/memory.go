@@ -0,0 +1,464 @@
+package rethinkgotest
+
+import (
+	"crypto/rand"
+	"fmt"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// DB is an in-memory RethinkDB backend.  Its Handle method runs queries
+// against in-memory tables instead of answering with canned responses, which
+// makes it possible to run realistic tests without a server.  It supports the
+// terms and builtins the driver produces, as well as inserts, updates,
+// replaces, deletes and meta queries, but not Javascript.
+//
+// Like a new server, a new DB contains an empty database named "test".
+//
+// Example usage:
+//
+//  server := rethinkgotest.NewLocalServer()
+//  defer server.Close()
+//  server.Handle(rethinkgotest.Any(), rethinkgotest.NewDB().Handle)
+//
+//  session, err := r.ConnectWithOpts(r.ConnectOpts{Database: "test", Dial: server.Dial})
+//  err = r.TableCreate("heroes").Run(session).Exec()
+//  err = r.Table("heroes").Insert(r.Map{"name": "Superman"}).Run(session).Exec()
+type DB struct {
+	mutex     sync.Mutex
+	databases map[string]map[string]*table
+}
+
+// table stores rows by the JSON encoding of their primary key.
+type table struct {
+	primaryKey string
+	rows       map[string]interface{}
+}
+
+// NewDB returns an in-memory backend containing an empty "test" database.
+func NewDB() *DB {
+	return &DB{databases: map[string]map[string]*table{"test": {}}}
+}
+
+// Handle runs a query, it can be passed to Server.Handle().
+func (db *DB) Handle(query *p.Query) (response Response) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err, ok := r.(queryError)
+			if !ok {
+				panic(r)
+			}
+			if err.bad {
+				response = BadQuery(err.message)
+			} else {
+				response = RuntimeError(err.message)
+			}
+		}
+	}()
+
+	ev := evaluator{db: db}
+	switch query.GetType() {
+	case p.Query_READ:
+		readQuery := query.GetReadQuery()
+		result := ev.eval(readQuery.GetTerm(), nil)
+		if rows, ok := result.(stream); ok {
+			response = Rows([]interface{}(rows)...)
+			response.ChunkSize = int(readQuery.GetMaxChunkSize())
+			return response
+		}
+		return JSON(result)
+	case p.Query_WRITE:
+		return JSON(ev.write(query.GetWriteQuery(), nil))
+	case p.Query_META:
+		return db.meta(query.GetMetaQuery())
+	}
+	return BadQuery(fmt.Sprintf("Unknown query type: %v", query.GetType()))
+}
+
+// meta runs a query that manages databases and tables.
+func (db *DB) meta(query *p.MetaQuery) Response {
+	switch query.GetType() {
+	case p.MetaQuery_CREATE_DB:
+		if _, ok := db.databases[query.GetDbName()]; ok {
+			runtimeError("Database `%v` already exists.", query.GetDbName())
+		}
+		db.databases[query.GetDbName()] = map[string]*table{}
+	case p.MetaQuery_DROP_DB:
+		db.database(query.GetDbName())
+		delete(db.databases, query.GetDbName())
+	case p.MetaQuery_LIST_DBS:
+		var names []string
+		for name := range db.databases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nameRows(names)
+	case p.MetaQuery_CREATE_TABLE:
+		createTable := query.GetCreateTable()
+		ref := createTable.GetTableRef()
+		tables := db.database(ref.GetDbName())
+		if _, ok := tables[ref.GetTableName()]; ok {
+			runtimeError("Table `%v` already exists.", ref.GetTableName())
+		}
+		tables[ref.GetTableName()] = &table{primaryKey: createTable.GetPrimaryKey(), rows: map[string]interface{}{}}
+	case p.MetaQuery_DROP_TABLE:
+		ref := query.GetDropTable()
+		db.table(ref)
+		delete(db.databases[ref.GetDbName()], ref.GetTableName())
+	case p.MetaQuery_LIST_TABLES:
+		names := []string{}
+		for name := range db.database(query.GetDbName()) {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nameRows(names)
+	default:
+		badQuery("Unknown meta query type: %v", query.GetType())
+	}
+	return Empty()
+}
+
+func (db *DB) database(name string) map[string]*table {
+	tables, ok := db.databases[name]
+	if !ok {
+		runtimeError("Database `%v` does not exist.", name)
+	}
+	return tables
+}
+
+func (db *DB) table(ref *p.TableRef) *table {
+	t, ok := db.database(ref.GetDbName())[ref.GetTableName()]
+	if !ok {
+		runtimeError("Table `%v` does not exist.", ref.GetTableName())
+	}
+	return t
+}
+
+// key returns the string used to store a row with the given primary key.
+func (t *table) key(value interface{}) string {
+	switch value.(type) {
+	case float64, string:
+		return toJSON(value)
+	}
+	runtimeError("Primary key must be a number or a string, not %v", toJSON(value))
+	return ""
+}
+
+// get returns the row with a primary key, or nil if there is none.
+func (t *table) get(key interface{}) interface{} {
+	return t.rows[t.key(key)]
+}
+
+// scan returns the rows of the table, ordered by primary key.
+func (t *table) scan() stream {
+	rows := stream{}
+	for _, row := range t.rows {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return compare(rows[i].(map[string]interface{})[t.primaryKey], rows[j].(map[string]interface{})[t.primaryKey]) < 0
+	})
+	return rows
+}
+
+// writeResult counts what a write query did, errors on individual rows are
+// counted instead of failing the whole query.
+type writeResult map[string]interface{}
+
+func newWriteResult(keys ...string) writeResult {
+	result := writeResult{}
+	for _, key := range keys {
+		result[key] = 0
+	}
+	return result
+}
+
+func (result writeResult) add(key string, n int) {
+	count, _ := result[key].(int)
+	result[key] = count + n
+}
+
+func (result writeResult) rowError(err interface{}) {
+	qerr, ok := err.(queryError)
+	if !ok {
+		panic(err)
+	}
+	result.add("errors", 1)
+	if _, ok := result["first_error"]; !ok {
+		result["first_error"] = qerr.message
+	}
+}
+
+// merge adds the counts of another result, for FOREACH queries.
+func (result writeResult) merge(other writeResult) {
+	for key, value := range other {
+		switch v := value.(type) {
+		case int:
+			result.add(key, v)
+		case []interface{}:
+			keys, _ := result[key].([]interface{})
+			result[key] = append(keys, v...)
+		default:
+			if _, ok := result[key]; !ok {
+				result[key] = value
+			}
+		}
+	}
+}
+
+// tryRow runs f for one row of a write query, counting an error instead of
+// failing the query if it panics.
+func (result writeResult) tryRow(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			result.rowError(r)
+		}
+	}()
+	f()
+}
+
+const nonDeterministicError = "Could not prove function deterministic.  Maybe you want to set the non_atomic flag?"
+
+// write runs a write query.
+func (ev evaluator) write(query *p.WriteQuery, sc *scope) writeResult {
+	atomic := query.Atomic == nil || query.GetAtomic()
+
+	switch query.GetType() {
+	case p.WriteQuery_INSERT:
+		insert := query.GetInsert()
+		t := ev.db.table(insert.GetTableRef())
+		result := newWriteResult("inserted", "errors")
+		var generatedKeys []interface{}
+		for _, term := range insert.Terms {
+			rows := []interface{}{ev.eval(term, sc)}
+			if items, ok := rows[0].([]interface{}); ok {
+				rows = items
+			} else if items, ok := rows[0].(stream); ok {
+				rows = items
+			}
+
+			for _, row := range rows {
+				result.tryRow(func() {
+					object := toObject(row)
+					if _, ok := object[t.primaryKey]; !ok {
+						key := newUUID()
+						object = copyObject(object)
+						object[t.primaryKey] = key
+						generatedKeys = append(generatedKeys, key)
+					}
+					k := t.key(object[t.primaryKey])
+					if _, exists := t.rows[k]; exists && !insert.GetOverwrite() {
+						runtimeError("Duplicate primary key %v: %v", t.primaryKey, toJSON(object[t.primaryKey]))
+					}
+					t.rows[k] = object
+					result.add("inserted", 1)
+				})
+			}
+		}
+		if len(generatedKeys) > 0 {
+			result["generated_keys"] = generatedKeys
+		}
+		return result
+
+	case p.WriteQuery_UPDATE:
+		update := query.GetUpdate()
+		t := ev.viewTable(update.GetView())
+		rows, _ := toSequence(ev.eval(update.GetView(), sc))
+		result := newWriteResult("updated", "skipped", "errors")
+		for _, row := range rows {
+			result.tryRow(func() {
+				if atomic && !deterministic(update.GetMapping()) {
+					runtimeError(nonDeterministicError)
+				}
+				result.add(ev.updateRow(t, row, update.GetMapping(), sc), 1)
+			})
+		}
+		return result
+
+	case p.WriteQuery_POINTUPDATE:
+		pointUpdate := query.GetPointUpdate()
+		t := ev.pointTable(pointUpdate.GetTableRef(), pointUpdate.GetAttrname())
+		if atomic && !deterministic(pointUpdate.GetMapping()) {
+			runtimeError(nonDeterministicError)
+		}
+		result := newWriteResult("updated", "skipped", "errors")
+		row := t.get(ev.eval(pointUpdate.GetKey(), sc))
+		if row == nil {
+			result.add("skipped", 1)
+			return result
+		}
+		result.add(ev.updateRow(t, row, pointUpdate.GetMapping(), sc), 1)
+		return result
+
+	case p.WriteQuery_MUTATE:
+		mutate := query.GetMutate()
+		t := ev.viewTable(mutate.GetView())
+		rows, _ := toSequence(ev.eval(mutate.GetView(), sc))
+		result := newWriteResult("modified", "inserted", "deleted", "errors")
+		for _, row := range rows {
+			result.tryRow(func() {
+				if atomic && !deterministic(mutate.GetMapping()) {
+					runtimeError(nonDeterministicError)
+				}
+				key := toObject(row)[t.primaryKey]
+				result.add(ev.replaceRow(t, key, row, mutate.GetMapping(), sc), 1)
+			})
+		}
+		return result
+
+	case p.WriteQuery_POINTMUTATE:
+		pointMutate := query.GetPointMutate()
+		t := ev.pointTable(pointMutate.GetTableRef(), pointMutate.GetAttrname())
+		if atomic && !deterministic(pointMutate.GetMapping()) {
+			runtimeError(nonDeterministicError)
+		}
+		result := newWriteResult("modified", "inserted", "deleted", "errors")
+		key := ev.eval(pointMutate.GetKey(), sc)
+		if change := ev.replaceRow(t, key, t.get(key), pointMutate.GetMapping(), sc); change != "" {
+			result.add(change, 1)
+		}
+		return result
+
+	case p.WriteQuery_DELETE:
+		view := query.GetDelete().GetView()
+		t := ev.viewTable(view)
+		rows, _ := toSequence(ev.eval(view, sc))
+		result := newWriteResult("deleted")
+		for _, row := range rows {
+			delete(t.rows, t.key(toObject(row)[t.primaryKey]))
+			result.add("deleted", 1)
+		}
+		return result
+
+	case p.WriteQuery_POINTDELETE:
+		pointDelete := query.GetPointDelete()
+		t := ev.pointTable(pointDelete.GetTableRef(), pointDelete.GetAttrname())
+		result := newWriteResult("deleted")
+		k := t.key(ev.eval(pointDelete.GetKey(), sc))
+		if _, ok := t.rows[k]; ok {
+			delete(t.rows, k)
+			result.add("deleted", 1)
+		}
+		return result
+
+	case p.WriteQuery_FOREACH:
+		forEach := query.GetForEach()
+		items, _ := toSequence(ev.eval(forEach.GetStream(), sc))
+		result := writeResult{}
+		for _, item := range items {
+			for _, inner := range forEach.Queries {
+				result.merge(ev.write(inner, sc.bind(forEach.GetVar(), item)))
+			}
+		}
+		return result
+	}
+
+	badQuery("Unknown write query type: %v", query.GetType())
+	return nil
+}
+
+// updateRow merges the result of a mapping into a row, returning "updated", or
+// "skipped" if the mapping returned null.
+func (ev evaluator) updateRow(t *table, row interface{}, mapping *p.Mapping, sc *scope) string {
+	changes := datum(ev.apply(mapping, row, sc))
+	if changes == nil {
+		return "skipped"
+	}
+
+	updated := copyObject(toObject(row))
+	for key, value := range toObject(changes) {
+		updated[key] = value
+	}
+	key := toObject(row)[t.primaryKey]
+	if compare(updated[t.primaryKey], key) != 0 {
+		runtimeError("update cannot change primary key %v (got objects %v, %v)", t.primaryKey, toJSON(row), toJSON(updated))
+	}
+	t.rows[t.key(key)] = updated
+	return "updated"
+}
+
+// replaceRow replaces the row with the given primary key, which may be nil if
+// there is no such row, by the result of a mapping.  It returns which of
+// "inserted", "modified" and "deleted" happened, or "" if nothing did.
+func (ev evaluator) replaceRow(t *table, key, row interface{}, mapping *p.Mapping, sc *scope) string {
+	replacement := datum(ev.apply(mapping, row, sc))
+	k := t.key(key)
+
+	if replacement == nil {
+		if row == nil {
+			return ""
+		}
+		delete(t.rows, k)
+		return "deleted"
+	}
+
+	object := toObject(replacement)
+	if compare(object[t.primaryKey], key) != 0 {
+		runtimeError("mutate cannot change primary key %v (got objects %v, %v)", t.primaryKey, toJSON(row), toJSON(replacement))
+	}
+	t.rows[k] = object
+	if row == nil {
+		return "inserted"
+	}
+	return "modified"
+}
+
+// viewTable finds the table that the rows of a view passed to a write query
+// come from.
+func (ev evaluator) viewTable(view *p.Term) *table {
+	var ref *p.TableRef
+	walkMessage(reflect.ValueOf(view), func(message interface{}) {
+		if r, ok := message.(*p.TableRef); ok && ref == nil {
+			ref = r
+		}
+	})
+	if ref == nil {
+		runtimeError("Expected a view of a table.")
+	}
+	return ev.db.table(ref)
+}
+
+// pointTable returns the table of a point write, checking that the attribute
+// is the primary key.
+func (ev evaluator) pointTable(ref *p.TableRef, attr string) *table {
+	t := ev.db.table(ref)
+	if attr != t.primaryKey {
+		runtimeError("Attribute: %v is not the primary key (%v) and thus cannot be selected upon.", attr, t.primaryKey)
+	}
+	return t
+}
+
+func copyObject(object map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, value := range object {
+		result[key] = value
+	}
+	return result
+}
+
+// newUUID returns a random (version 4) UUID, like the ones the server
+// generates for rows inserted without a primary key.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// nameRows returns a list of databases or tables as a stream, the way the
+// server does
+func nameRows(names []string) Response {
+	var rows []interface{}
+	for _, name := range names {
+		rows = append(rows, name)
+	}
+	return Rows(rows...)
+}
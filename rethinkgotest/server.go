@@ -0,0 +1,583 @@
+// Package rethinkgotest provides a fake RethinkDB server for testing code that
+// uses rethinkgo without a real database.
+//
+// The server speaks the same wire protocol as RethinkDB, so a normal
+// rethinkgo session can connect to it, but instead of running queries it
+// answers them with scripted handlers.  Each handler is paired with a Matcher
+// that picks the queries it answers, the first matching handler wins.  Queries
+// that no handler matches get a BAD_QUERY error.
+//
+// Example usage:
+//
+//  server, err := rethinkgotest.NewServer()
+//  if err != nil {
+//      t.Fatal(err)
+//  }
+//  defer server.Close()
+//
+//  // return the rows of "heroes" 2 at a time, as a real server would for a
+//  // large table
+//  rows := rethinkgotest.Rows(r.Map{"name": "Superman"}, r.Map{"name": "Batman"}, r.Map{"name": "Flash"})
+//  server.On(rethinkgotest.Read("heroes"), rows.Chunks(2))
+//  server.On(rethinkgotest.Write("heroes"), rethinkgotest.RuntimeError("table is read-only"))
+//
+//  session, err := r.Connect(server.Address(), "test")
+package rethinkgotest
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// the magic number a client sends when it connects
+const clientHello uint32 = 0xaf61ba35
+
+// Matcher decides whether a handler should answer a query.
+type Matcher func(query *p.Query) bool
+
+// Handler answers a query that its Matcher picked.
+type Handler func(query *p.Query) Response
+
+type route struct {
+	match   Matcher
+	handler Handler
+}
+
+// Server is a fake RethinkDB server listening on a local port.
+type Server struct {
+	listener net.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mutex   sync.Mutex
+	routes  []route
+	queries []*p.Query
+	conns   map[net.Conn]bool
+	closed  bool
+}
+
+// NewServer starts a fake server listening on a random port of the loopback
+// interface.  Use Address() to connect to it and Close() to stop it.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		done:     make(chan struct{}),
+		conns:    map[net.Conn]bool{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// NewLocalServer returns a fake server that doesn't listen on the network,
+// sessions connect to it through its Dial method instead.  Use Close() to stop
+// it.
+//
+// Example usage:
+//
+//  server := rethinkgotest.NewLocalServer()
+//  defer server.Close()
+//  session, err := r.ConnectWithOpts(r.ConnectOpts{Database: "test", Dial: server.Dial})
+func NewLocalServer() *Server {
+	return &Server{
+		done:  make(chan struct{}),
+		conns: map[net.Conn]bool{},
+	}
+}
+
+// Address returns the "host:port" address of the server, to pass to
+// rethinkgo's Connect().  It returns "" for a server made by NewLocalServer().
+func (s *Server) Address() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Dial connects to the server through an in-memory pipe, it can be used as
+// ConnectOpts.Dial to connect a session to the server without a network.  The
+// network and address are ignored.
+func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, errors.New("rethinkgotest: server is closed")
+	}
+	s.conns[server] = true
+	s.wg.Add(1)
+	go s.serveConn(server)
+	return client, nil
+}
+
+// Close stops the server and closes all connections to it, any responses that
+// are waiting for their delay are dropped.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Handle adds a handler for the queries picked by match.  Handlers are tried in
+// the order they were added.
+//
+// Example usage:
+//
+//  server.Handle(rethinkgotest.Read("heroes"), func(query *p.Query) rethinkgotest.Response {
+//      return rethinkgotest.JSON(len(server.Queries()))
+//  })
+func (s *Server) Handle(match Matcher, handler Handler) {
+	s.mutex.Lock()
+	s.routes = append(s.routes, route{match: match, handler: handler})
+	s.mutex.Unlock()
+}
+
+// On adds a handler that gives the same response to every query picked by
+// match.
+//
+// Example usage:
+//
+//  server.On(rethinkgotest.Read("heroes"), rethinkgotest.Rows(r.Map{"name": "Superman"}))
+func (s *Server) On(match Matcher, response Response) {
+	s.Handle(match, func(*p.Query) Response { return response })
+}
+
+// Reset removes all handlers and forgets the queries received so far.
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	s.routes = nil
+	s.queries = nil
+	s.mutex.Unlock()
+}
+
+// Queries returns the queries the server has received, in the order they
+// arrived, including the CONTINUE and STOP queries sent while iterating over a
+// stream.
+func (s *Server) Queries() []*p.Query {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*p.Query(nil), s.queries...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// serverConn is a connection from a client, which may have several queries in
+// flight if the client is pipelining.
+type serverConn struct {
+	net.Conn
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	streams map[int64]*partialStream // partial results waiting for a CONTINUE
+}
+
+// partialStream is the rest of a result that is sent in chunks.
+type partialStream struct {
+	rows      []string
+	chunkSize int
+	delay     time.Duration
+}
+
+func (s *Server) serveConn(netConn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, netConn)
+		s.mutex.Unlock()
+		netConn.Close()
+	}()
+
+	var hello uint32
+	if err := binary.Read(netConn, binary.LittleEndian, &hello); err != nil || hello != clientHello {
+		return
+	}
+
+	conn := &serverConn{Conn: netConn, streams: map[int64]*partialStream{}}
+	for {
+		query, err := conn.readQuery()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		s.queries = append(s.queries, query)
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		// answer each query on its own so a delayed response doesn't hold up
+		// the other queries of a pipelining client
+		go func() {
+			defer s.wg.Done()
+			s.answer(conn, query)
+		}()
+	}
+}
+
+// answer runs the handler for a query and sends the response.
+func (s *Server) answer(conn *serverConn, query *p.Query) {
+	token := query.GetToken()
+
+	switch query.GetType() {
+	case p.Query_CONTINUE:
+		conn.mutex.Lock()
+		st := conn.streams[token]
+		conn.mutex.Unlock()
+		if st == nil {
+			s.send(conn, 0, brokenClient(token, "Token not in stream cache."))
+			return
+		}
+		s.sendChunk(conn, token, st)
+		return
+	case p.Query_STOP:
+		conn.mutex.Lock()
+		delete(conn.streams, token)
+		conn.mutex.Unlock()
+		s.send(conn, 0, &p.Response{StatusCode: p.Response_SUCCESS_EMPTY.Enum(), Token: proto.Int64(token)})
+		return
+	}
+
+	response := s.handle(query)
+	if response.hangup {
+		if s.wait(response.Delay) {
+			conn.Close()
+		}
+		return
+	}
+	if response.err != nil {
+		s.send(conn, response.Delay, errorResponse(token, p.Response_RUNTIME_ERROR, response.err.Error(), nil))
+		return
+	}
+	if response.Status != p.Response_SUCCESS_STREAM || response.ChunkSize <= 0 {
+		s.send(conn, response.Delay, response.toProto(token))
+		return
+	}
+
+	s.sendChunk(conn, token, &partialStream{rows: response.rows, chunkSize: response.ChunkSize, delay: response.Delay})
+}
+
+// handle finds the handler for a query and runs it.
+func (s *Server) handle(query *p.Query) Response {
+	s.mutex.Lock()
+	routes := s.routes
+	s.mutex.Unlock()
+
+	for _, r := range routes {
+		if r.match(query) {
+			return r.handler(query)
+		}
+	}
+	return BadQuery(fmt.Sprintf("rethinkgotest: no handler for query: %v", query))
+}
+
+// sendChunk sends the next chunk of a stream, keeping the rest for the next
+// CONTINUE query.
+func (s *Server) sendChunk(conn *serverConn, token int64, st *partialStream) {
+	status := p.Response_SUCCESS_STREAM
+	rows := st.rows
+	conn.mutex.Lock()
+	if len(rows) > st.chunkSize {
+		status = p.Response_SUCCESS_PARTIAL
+		rows = rows[:st.chunkSize]
+		conn.streams[token] = &partialStream{rows: st.rows[st.chunkSize:], chunkSize: st.chunkSize, delay: st.delay}
+	} else {
+		delete(conn.streams, token)
+	}
+	conn.mutex.Unlock()
+
+	s.send(conn, st.delay, &p.Response{StatusCode: status.Enum(), Token: proto.Int64(token), Response: rows})
+}
+
+// send writes a response after waiting for delay.
+func (s *Server) send(conn *serverConn, delay time.Duration, response *p.Response) {
+	if !s.wait(delay) {
+		return
+	}
+	data, err := proto.Marshal(response)
+	if err != nil {
+		data, _ = proto.Marshal(errorResponse(response.GetToken(), p.Response_BROKEN_CLIENT, err.Error(), nil))
+	}
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if err := binary.Write(conn, binary.LittleEndian, uint32(len(data))); err != nil {
+		return
+	}
+	conn.Write(data)
+}
+
+// wait sleeps for delay, returning false if the server was closed meanwhile.
+func (s *Server) wait(delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// readQuery reads a length-prefixed query protobuf.
+func (conn *serverConn) readQuery() (*p.Query, error) {
+	var length uint32
+	if err := binary.Read(conn, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+
+	query := &p.Query{}
+	if err := proto.Unmarshal(data, query); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// Response is the answer a handler gives to a query.  Create one with Rows(),
+// JSON(), Empty(), RuntimeError(), BadQuery() or Hangup().
+type Response struct {
+	// Status is the status code sent to the client
+	Status p.Response_StatusCode
+	// ErrorMessage and Backtrace are sent with error status codes
+	ErrorMessage string
+	Backtrace    []string
+	// ChunkSize splits a SUCCESS_STREAM response into SUCCESS_PARTIAL responses
+	// of at most this many rows, the client has to send a CONTINUE query for
+	// each of them
+	ChunkSize int
+	// Delay is how long to wait before sending each response, to test timeouts
+	Delay time.Duration
+
+	rows   []string
+	err    error // set if the rows could not be encoded
+	hangup bool
+}
+
+// Rows returns a SUCCESS_STREAM response containing rows, which are encoded
+// with encoding/json.
+func Rows(rows ...interface{}) Response {
+	response := Response{Status: p.Response_SUCCESS_STREAM, rows: []string{}}
+	for _, row := range rows {
+		data, err := json.Marshal(row)
+		if err != nil {
+			response.err = fmt.Errorf("rethinkgotest: could not encode row: %v", err)
+			return response
+		}
+		response.rows = append(response.rows, string(data))
+	}
+	return response
+}
+
+// JSON returns a SUCCESS_JSON response containing a single value, which is
+// encoded with encoding/json.  This is what the server sends for queries that
+// return a single value, and for write queries.
+func JSON(value interface{}) Response {
+	response := Rows(value)
+	response.Status = p.Response_SUCCESS_JSON
+	return response
+}
+
+// Empty returns a SUCCESS_EMPTY response, which the server sends for queries
+// that return nothing, like creating a table.
+func Empty() Response {
+	return Response{Status: p.Response_SUCCESS_EMPTY}
+}
+
+// RuntimeError returns a RUNTIME_ERROR response, backtrace is a list of
+// frames locating the part of the query that failed.
+func RuntimeError(message string, backtrace ...string) Response {
+	return Response{Status: p.Response_RUNTIME_ERROR, ErrorMessage: message, Backtrace: backtrace}
+}
+
+// BadQuery returns a BAD_QUERY response.
+func BadQuery(message string, backtrace ...string) Response {
+	return Response{Status: p.Response_BAD_QUERY, ErrorMessage: message, Backtrace: backtrace}
+}
+
+// Hangup closes the connection instead of answering the query, as if the
+// server had gone away.
+func Hangup() Response {
+	return Response{hangup: true}
+}
+
+// Chunks returns a copy of a SUCCESS_STREAM response that is sent n rows at a
+// time.
+func (response Response) Chunks(n int) Response {
+	response.ChunkSize = n
+	return response
+}
+
+// After returns a copy of the response that is sent after waiting for delay.
+func (response Response) After(delay time.Duration) Response {
+	response.Delay = delay
+	return response
+}
+
+func (response Response) toProto(token int64) *p.Response {
+	switch response.Status {
+	case p.Response_SUCCESS_JSON, p.Response_SUCCESS_STREAM, p.Response_SUCCESS_PARTIAL:
+		return &p.Response{StatusCode: response.Status.Enum(), Token: proto.Int64(token), Response: response.rows}
+	case p.Response_SUCCESS_EMPTY:
+		return &p.Response{StatusCode: response.Status.Enum(), Token: proto.Int64(token)}
+	}
+	return errorResponse(token, response.Status, response.ErrorMessage, response.Backtrace)
+}
+
+func errorResponse(token int64, status p.Response_StatusCode, message string, backtrace []string) *p.Response {
+	response := &p.Response{
+		StatusCode:   status.Enum(),
+		Token:        proto.Int64(token),
+		ErrorMessage: proto.String(message),
+	}
+	if len(backtrace) > 0 {
+		response.Backtrace = &p.Response_Backtrace{Frame: backtrace}
+	}
+	return response
+}
+
+func brokenClient(token int64, message string) *p.Response {
+	return errorResponse(token, p.Response_BROKEN_CLIENT, message, nil)
+}
+
+// Any matches every query.
+func Any() Matcher {
+	return func(*p.Query) bool { return true }
+}
+
+// Read matches read queries that use the given table.  An empty table name
+// matches every read query.
+func Read(table string) Matcher {
+	return queryType(p.Query_READ, table)
+}
+
+// Write matches write queries that use the given table.  An empty table name
+// matches every write query.
+func Write(table string) Matcher {
+	return queryType(p.Query_WRITE, table)
+}
+
+// Meta matches meta queries of the given type, like creating or listing tables.
+//
+// Example usage:
+//
+//  server.On(rethinkgotest.Meta(p.MetaQuery_LIST_TABLES), rethinkgotest.JSON([]string{"heroes"}))
+func Meta(metaType p.MetaQuery_MetaQueryType) Matcher {
+	return func(query *p.Query) bool {
+		return query.GetType() == p.Query_META && query.GetMetaQuery().GetType() == metaType
+	}
+}
+
+func queryType(queryType p.Query_QueryType, table string) Matcher {
+	return func(query *p.Query) bool {
+		if query.GetType() != queryType {
+			return false
+		}
+		if table == "" {
+			return true
+		}
+		for _, name := range Tables(query) {
+			if name == table {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Tables returns the names of the tables a query uses, in the order they
+// appear in the query.
+func Tables(query *p.Query) []string {
+	var tables []string
+	walkMessage(reflect.ValueOf(query), func(message interface{}) {
+		if ref, ok := message.(*p.TableRef); ok {
+			tables = append(tables, ref.GetTableName())
+		}
+	})
+	return tables
+}
+
+// walkMessage calls f for each message nested in a protobuf message, in the
+// order they appear.  There are a lot of places a table or a term can appear,
+// so we just look everywhere.
+func walkMessage(value reflect.Value, f func(message interface{})) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() || value.Elem().Kind() != reflect.Struct {
+			return
+		}
+		f(value.Interface())
+		walkMessage(value.Elem(), f)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).PkgPath == "" {
+				walkMessage(value.Field(i), f)
+			}
+		}
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.Ptr {
+			return
+		}
+		for i := 0; i < value.Len(); i++ {
+			walkMessage(value.Index(i), f)
+		}
+	}
+}
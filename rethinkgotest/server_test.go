@@ -0,0 +1,1051 @@
+package rethinkgotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	r "github.com/christopherhesse/rethinkgo"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"iter"
+	. "launchpad.net/gocheck"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ServerSuite struct {
+	server  *Server
+	session *r.Session
+}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	var err error
+	s.server, err = NewServer()
+	c.Assert(err, IsNil)
+	s.session, err = r.Connect(s.server.Address(), "test")
+	c.Assert(err, IsNil)
+}
+
+func (s *ServerSuite) TearDownTest(c *C) {
+	s.session.Close()
+	s.server.Close()
+}
+
+type hero struct {
+	Name string
+}
+
+func (s *ServerSuite) TestChunks(c *C) {
+	rows := Rows(hero{"Superman"}, hero{"Batman"}, hero{"Flash"}, hero{"Aquaman"}, hero{"Cyborg"})
+	s.server.On(Read("heroes"), rows.Chunks(2))
+
+	var heroes []hero
+	err := r.Table("heroes").Run(s.session).Collect(&heroes)
+	c.Assert(err, IsNil)
+	c.Assert(heroes, DeepEquals, []hero{{"Superman"}, {"Batman"}, {"Flash"}, {"Aquaman"}, {"Cyborg"}})
+
+	var types []p.Query_QueryType
+	for _, query := range s.server.Queries() {
+		types = append(types, query.GetType())
+	}
+	c.Assert(types, DeepEquals, []p.Query_QueryType{p.Query_READ, p.Query_CONTINUE, p.Query_CONTINUE})
+
+	// closing early stops the stream
+	query := r.Table("heroes").Filter(r.Row.Attr("Name").Ne("Flash"))
+	iter := query.Run(s.session)
+	var h hero
+	c.Assert(iter.Next(&h), Equals, true)
+	c.Assert(iter.Close(), IsNil)
+	queries := s.server.Queries()
+	c.Assert(queries[len(queries)-1].GetType(), Equals, p.Query_STOP)
+}
+
+func (s *ServerSuite) TestRunOpts(c *C) {
+	chunked := func(query *p.Query) Response {
+		rows := Rows(1, 2, 3, 4, 5)
+		return rows.Chunks(int(query.GetReadQuery().GetMaxChunkSize()))
+	}
+	s.server.Handle(Any(), chunked)
+
+	var numbers []int
+	err := r.Table("numbers").RunOpts(s.session, r.RunOpts{ChunkSize: 2, MaxAge: time.Minute}).Collect(&numbers)
+	c.Assert(err, IsNil)
+	c.Assert(numbers, DeepEquals, []int{1, 2, 3, 4, 5})
+	readQuery := s.server.Queries()[0].GetReadQuery()
+	c.Assert(readQuery.GetMaxChunkSize(), Equals, int64(2))
+	c.Assert(readQuery.GetMaxAge(), Equals, int64(60))
+	c.Assert(s.server.Queries(), HasLen, 3)
+
+	// session defaults apply unless the query overrides them
+	s.server.Reset()
+	s.server.Handle(Any(), chunked)
+	s.session.SetRunOpts(r.RunOpts{ChunkSize: 4})
+	err = r.Table("numbers").Run(s.session).Collect(&numbers)
+	c.Assert(err, IsNil)
+	c.Assert(s.server.Queries(), HasLen, 2)
+	err = r.Table("numbers").RunOpts(s.session, r.RunOpts{ChunkSize: -1}).Collect(&numbers)
+	c.Assert(err, IsNil)
+	c.Assert(s.server.Queries(), HasLen, 3)
+	c.Assert(s.server.Queries()[2].GetReadQuery().MaxChunkSize, NotNil)
+}
+
+// waitForQueries waits until the server has received n queries
+func (s *ServerSuite) waitForQueries(c *C, n int) {
+	deadline := time.Now().Add(time.Second)
+	for len(s.server.Queries()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(s.server.Queries(), HasLen, n)
+}
+
+func (s *ServerSuite) TestPrefetch(c *C) {
+	s.server.On(Read("numbers"), Rows(1, 2, 3, 4, 5, 6, 7, 8).Chunks(2))
+	opts := r.RunOpts{Prefetch: 2}
+
+	// the next two chunks are fetched before the first one is used up
+	rows := r.Table("numbers").RunOpts(s.session, opts)
+	var n int
+	c.Assert(rows.Next(&n), Equals, true)
+	s.waitForQueries(c, 3)
+	numbers := []int{n}
+	for rows.Next(&n) {
+		numbers = append(numbers, n)
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(numbers, DeepEquals, []int{1, 2, 3, 4, 5, 6, 7, 8})
+	c.Assert(s.session.Stats().InUse, Equals, 0)
+
+	// closing early stops the stream and returns the connection
+	s.server.Reset()
+	s.server.On(Read("numbers"), Rows(1, 2, 3, 4, 5, 6, 7, 8).Chunks(2))
+	rows = r.Table("numbers").RunOpts(s.session, opts)
+	c.Assert(rows.Next(&n), Equals, true)
+	c.Assert(rows.Close(), IsNil)
+	queries := s.server.Queries()
+	c.Assert(queries[len(queries)-1].GetType(), Equals, p.Query_STOP)
+	c.Assert(s.session.Stats().InUse, Equals, 0)
+	c.Assert(s.session.Stats().Idle, Equals, 1)
+
+	// the goroutine doesn't wait forever for an iterator that isn't used
+	// anymore, once its context is done
+	s.server.Reset()
+	s.server.On(Read("numbers"), Rows(1, 2, 3, 4, 5, 6, 7, 8).Chunks(2))
+	s.session.SetRunOpts(r.RunOpts{Prefetch: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	rows = s.session.RunContext(ctx, r.Table("numbers"))
+	c.Assert(rows.Next(&n), Equals, true)
+	s.waitForQueries(c, 2)
+	before := runtime.NumGoroutine()
+	cancel()
+	waitForGoroutines(c, before-1)
+	c.Assert(rows.Next(&n), Equals, true)
+	c.Assert(rows.Next(&n), Equals, false)
+	c.Assert(rows.Err(), Equals, context.Canceled)
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(s.session.Stats().InUse, Equals, 0)
+}
+
+// lastQuery returns the type of the last query the server received
+func (s *ServerSuite) lastQuery() p.Query_QueryType {
+	queries := s.server.Queries()
+	return queries[len(queries)-1].GetType()
+}
+
+func (s *ServerSuite) TestStreaming(c *C) {
+	s.server.On(Read("heroes"), Rows(hero{"Superman"}, hero{"Batman"}, hero{"Flash"}).Chunks(1))
+	query := r.Table("heroes")
+
+	var names []string
+	for row := range query.Run(s.session).Chan(context.Background()) {
+		var h hero
+		c.Assert(row.Decode(&h), IsNil)
+		names = append(names, h.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"Superman", "Batman", "Flash"})
+
+	// cancelling the context stops the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := query.Run(s.session).Chan(ctx)
+	<-ch
+	cancel()
+	for range ch {
+	}
+	c.Assert(s.session.Stats().InUse, Equals, 0)
+
+	errStop := errors.New("stop")
+	names = nil
+	err := query.Run(s.session).ForEach(func(h hero) error {
+		names = append(names, h.Name)
+		if h.Name == "Batman" {
+			return errStop
+		}
+		return nil
+	})
+	c.Assert(err, Equals, errStop)
+	c.Assert(names, DeepEquals, []string{"Superman", "Batman"})
+	c.Assert(s.lastQuery(), Equals, p.Query_STOP)
+
+	err = query.Run(s.session).ForEach(func(h hero) {})
+	c.Assert(err, ErrorMatches, ".*func\\(row T\\) error.*")
+	err = query.Run(s.session).ForEach(nil)
+	c.Assert(err, ErrorMatches, ".*func\\(row T\\) error.*")
+
+	names = nil
+	for h, err := range r.Stream[hero](query.Run(s.session)) {
+		c.Assert(err, IsNil)
+		names = append(names, h.Name)
+		break
+	}
+	c.Assert(names, DeepEquals, []string{"Superman"})
+	c.Assert(s.lastQuery(), Equals, p.Query_STOP)
+	c.Assert(s.session.Stats().InUse, Equals, 0)
+
+	s.server.On(Read("villains"), RuntimeError("Table `villains` does not exist."))
+	for _, err := range r.Stream[hero](r.Table("villains").Run(s.session)) {
+		c.Assert(err, ErrorMatches, ".*does not exist.*")
+	}
+}
+
+func (s *ServerSuite) TestChanError(c *C) {
+	s.server.On(Read("heroes"), Rows(hero{"Superman"}, hero{"Batman"}).Chunks(1))
+
+	// the stream fails while nobody is reading, then the reader cancels, which
+	// must still close the iterator
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := r.Table("heroes").Run(s.session).Chan(ctx)
+	<-ch
+	s.server.Close()
+	time.Sleep(50 * time.Millisecond)
+	blocked := runtime.NumGoroutine()
+	cancel()
+	waitForGoroutines(c, blocked-1)
+}
+
+func (s *ServerSuite) TestRaw(c *C) {
+	s.server.On(Read("heroes"), Rows(hero{"Superman"}, hero{"Batman"}, hero{"Flash"}).Chunks(2))
+	query := r.Table("heroes")
+
+	rows := query.Run(s.session)
+	row, ok := rows.NextRaw()
+	c.Assert(ok, Equals, true)
+	c.Assert(string(row), Equals, `{"Name":"Superman"}`)
+
+	// the buffer is reused if it's big enough
+	buf := make([]byte, 0, 100)
+	row, ok = rows.NextRawContext(context.Background(), buf)
+	c.Assert(ok, Equals, true)
+	c.Assert(string(row), Equals, `{"Name":"Batman"}`)
+	c.Assert(&row[0], Equals, &buf[:1][0])
+	row, ok = rows.NextRawContext(context.Background(), row)
+	c.Assert(ok, Equals, true)
+	c.Assert(string(row), Equals, `{"Name":"Flash"}`)
+	_, ok = rows.NextRaw()
+	c.Assert(ok, Equals, false)
+	c.Assert(rows.Err(), IsNil)
+
+	// the decode function can keep and modify the data it's given
+	var decoded [][]byte
+	s.session.SetDecodeFunc(func(data []byte, dest interface{}) error {
+		err := json.Unmarshal(data, dest)
+		data[0] = '!'
+		decoded = append(decoded, data)
+		return err
+	})
+	var heroes []hero
+	err := query.Run(s.session).Collect(&heroes)
+	c.Assert(err, IsNil)
+	c.Assert(heroes, DeepEquals, []hero{{"Superman"}, {"Batman"}, {"Flash"}})
+	c.Assert(decoded, HasLen, 3)
+	c.Assert(string(decoded[0]), Equals, `!"Name":"Superman"}`)
+	c.Assert(string(decoded[2]), Equals, `!"Name":"Flash"}`)
+}
+
+func (s *ServerSuite) TestFinalChunk(c *C) {
+	s.server.On(Read("numbers"), Rows(1, 2, 3, 4, 5, 6).Chunks(4))
+
+	// every row of the last chunk is returned, and the connection is back in
+	// the pool before they're read
+	rows := r.Table("numbers").Run(s.session)
+	var numbers []int
+	var n int
+	for rows.Next(&n) {
+		numbers = append(numbers, n)
+		if len(numbers) == 5 {
+			c.Assert(s.session.Stats().InUse, Equals, 0)
+		}
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(numbers, DeepEquals, []int{1, 2, 3, 4, 5, 6})
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(s.server.Queries(), HasLen, 2)
+}
+
+func (s *ServerSuite) TestMatchers(c *C) {
+	s.server.On(Read("villains"), JSON(1))
+	s.server.On(Read(""), JSON(2))
+	s.server.On(Write("heroes"), JSON(r.Map{"inserted": 1}))
+	s.server.On(Meta(p.MetaQuery_LIST_TABLES), JSON([]string{"heroes"}))
+
+	var n int
+	err := r.Table("heroes").InnerJoin(r.Table("villains"), func(left, right r.Exp) r.Exp {
+		return r.Expr(true)
+	}).Count().Run(s.session).One(&n)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	err = r.Table("heroes").Count().Run(s.session).One(&n)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	var response r.WriteResponse
+	err = r.Table("heroes").Insert(hero{"Flash"}).Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Inserted, Equals, 1)
+
+	var tables []string
+	err = r.Db("test").TableList().Run(s.session).One(&tables)
+	c.Assert(err, IsNil)
+	c.Assert(tables, DeepEquals, []string{"heroes"})
+
+	// nothing matches creating a table
+	err = r.Db("test").TableCreate("villains").Run(s.session).Err()
+	c.Assert(err, ErrorMatches, ".*no handler for query.*")
+}
+
+func (s *ServerSuite) TestErrors(c *C) {
+	s.server.On(Read("heroes"), RuntimeError("Table `heroes` does not exist."))
+
+	err := r.Table("heroes").Run(s.session).Err()
+	c.Assert(err, FitsTypeOf, r.ErrRuntime{})
+	c.Assert(err, ErrorMatches, ".*Table `heroes` does not exist.*")
+	c.Assert(r.IsTableNotFound(err), Equals, true)
+	c.Assert(r.IsDatabaseExists(err), Equals, false)
+	c.Assert(r.IsTableNotFound(fmt.Errorf("wrapped: %w", err)), Equals, true)
+	c.Assert(errors.Is(err, r.ErrRuntime{}), Equals, true)
+	c.Assert(errors.Is(err, r.ErrBadQuery{}), Equals, false)
+	c.Assert(r.IsServerError(fmt.Errorf("wrapped: %w", err)), Equals, true)
+
+	s.server.On(Read("villains"), BadQuery("Expected a number.", "arg:1", "body"))
+	err = r.Table("villains").Run(s.session).Err()
+	var badQuery r.ErrBadQuery
+	c.Assert(errors.As(err, &badQuery), Equals, true)
+	c.Assert(badQuery.Message(), Equals, "Expected a number.")
+	c.Assert(badQuery.Backtrace(), DeepEquals, []string{"arg:1", "body"})
+	c.Assert(badQuery.Token(), Equals, s.server.Queries()[1].GetToken())
+	c.Assert(r.IsServerError(err), Equals, true)
+
+	s.server.On(Read("numbers"), Rows(1, 2))
+	var n int
+	err = r.Table("numbers").Run(s.session).One(&n)
+	c.Assert(err, FitsTypeOf, r.ErrWrongResponseType{})
+	c.Assert(err.(r.ErrWrongResponseType).Status(), Equals, p.Response_SUCCESS_STREAM)
+	c.Assert(err, ErrorMatches, ".*Wrong response type SUCCESS_STREAM.*")
+}
+
+func (s *ServerSuite) TestBacktrace(c *C) {
+	s.server.On(Read("heroes"), RuntimeError("Can only ADD numbers with numbers.", "mapping", "body"))
+	query := r.Table("heroes").Map(r.Row.Attr("name").Add(1))
+
+	err := query.Run(s.session).Err()
+	c.Assert(err, FitsTypeOf, r.ErrRuntime{})
+	c.Assert(err.(r.ErrRuntime).Expression(), Equals, r.Row.Attr("name").Add(1).String())
+	c.Assert(err.(r.ErrRuntime).CallSite(), Equals, "")
+	c.Assert(err, ErrorMatches, `.*\[mapping body\] in Row.Attr.*`)
+
+	s.server.Reset()
+	s.server.On(Read("heroes"), RuntimeError("Can only ADD numbers with numbers.", "mapping", "body", "arg:1"))
+	r.SetDebugCallSites(true)
+	defer r.SetDebugCallSites(false)
+	_, file, line, _ := runtime.Caller(0)
+	query = r.Table("heroes").Map(func(row r.Exp) r.Exp {
+		return row.Attr("name").Add(1)
+	})
+
+	err = query.Run(s.session).Err()
+	c.Assert(err.(r.ErrRuntime).Expression(), Equals, "Expr(1)")
+	// a literal uses the call site of the expression it's in
+	c.Assert(err.(r.ErrRuntime).CallSite(), Equals, fmt.Sprintf("%v:%v", file, line+2))
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`.* in Expr\(1\) \(built at %v:%v\)`, file, line+2))
+
+	// frames that don't match the query are ignored
+	s.server.Reset()
+	s.server.On(Write("heroes"), BadQuery("Expected a number.", "view", "nonsense:3"))
+	err = r.Table("heroes").Filter(r.Map{"name": "Superman"}).Delete().Run(s.session).Err()
+	c.Assert(err.(r.ErrBadQuery).Expression(), Matches, `Table\("heroes"\).Filter.*`)
+	c.Assert(err.(r.ErrBadQuery).CallSite(), Matches, ".*server_test.go:[0-9]+")
+}
+
+// queryRecorder is a QueryHook that remembers the queries it's told about
+type queryRecorder struct {
+	mutex   sync.Mutex
+	queries []string
+}
+
+func (h *queryRecorder) BeforeQuery(ctx context.Context, info *r.QueryInfo) context.Context {
+	return ctx
+}
+
+func (h *queryRecorder) AfterQuery(ctx context.Context, info *r.QueryInfo, status p.Response_StatusCode, err error, duration time.Duration, rowCount int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.queries = append(h.queries, fmt.Sprintf("%v %v %v %v", info.Type, info.Query, status, rowCount))
+}
+
+// recordedSpan is a Span kept in memory by a spanRecorder
+type recordedSpan struct {
+	name       string
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (span *recordedSpan) SetAttribute(key string, value interface{}) { span.attributes[key] = value }
+func (span *recordedSpan) SetError(err error)                         { span.err = err }
+func (span *recordedSpan) End()                                       { span.ended = true }
+
+type spanRecorder struct {
+	spans []*recordedSpan
+}
+
+func (rec *spanRecorder) start(ctx context.Context, name string) (context.Context, r.Span) {
+	span := &recordedSpan{name: name, attributes: map[string]interface{}{}}
+	rec.spans = append(rec.spans, span)
+	return ctx, span
+}
+
+func (s *ServerSuite) TestQueryHook(c *C) {
+	s.server.On(Read("numbers"), Rows(1, 2, 3, 4, 5).Chunks(2))
+	hook := &queryRecorder{}
+	s.session.SetQueryHook(hook)
+
+	var numbers []int
+	err := r.Table("numbers").Run(s.session).Collect(&numbers)
+	c.Assert(err, IsNil)
+	rows := r.Table("numbers").Run(s.session)
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(hook.queries, DeepEquals, []string{
+		`READ Table("numbers") SUCCESS_PARTIAL 2`,
+		`CONTINUE Table("numbers") SUCCESS_PARTIAL 2`,
+		`CONTINUE Table("numbers") SUCCESS_STREAM 1`,
+		`READ Table("numbers") SUCCESS_PARTIAL 2`,
+		`STOP Table("numbers") SUCCESS_EMPTY 0`,
+	})
+
+	s.server.On(Read("heroes"), RuntimeError("Table `heroes` does not exist."))
+	recorder := &spanRecorder{}
+	s.session.SetQueryHook(r.TracingHook(recorder.start))
+	err = r.Table("heroes").Run(s.session).Err()
+	c.Assert(err, NotNil)
+	c.Assert(recorder.spans, HasLen, 1)
+	span := recorder.spans[0]
+	c.Assert(span.name, Equals, "rethinkdb READ")
+	c.Assert(span.attributes["db.system"], Equals, "rethinkdb")
+	c.Assert(span.attributes["db.statement"], Equals, `Table("heroes")`)
+	c.Assert(span.attributes["rethinkdb.status"], Equals, "RUNTIME_ERROR")
+	c.Assert(span.err, Equals, err)
+	c.Assert(span.ended, Equals, true)
+
+	var buffer bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s.session.SetQueryHook(r.SlogHook(logger))
+	var n int
+	c.Assert(r.Table("numbers").Run(s.session).One(&n), NotNil)
+	c.Assert(buffer.String(), Matches, `.*level=DEBUG msg="rethinkdb query" token=[0-9]+ type=READ query="Table\(\\"numbers\\"\)" duration=.* status=SUCCESS_PARTIAL rows=2\n`)
+	buffer.Reset()
+	c.Assert(r.Table("heroes").Run(s.session).Err(), NotNil)
+	c.Assert(buffer.String(), Matches, `.*level=ERROR .* status=RUNTIME_ERROR rows=0 error=.*does not exist.*\n`)
+
+	// without a hook, nothing is recorded
+	s.session.SetQueryHook(nil)
+	c.Assert(r.Table("heroes").Run(s.session).Err(), NotNil)
+	c.Assert(recorder.spans, HasLen, 1)
+	c.Assert(hook.queries, HasLen, 5)
+}
+
+func (s *ServerSuite) TestLeakDetector(c *C) {
+	s.server.On(Read("numbers"), Rows(1, 2, 3, 4, 5).Chunks(2))
+
+	// open iterators are listed without a leak detector, but not where they
+	// were created
+	rows := r.Table("numbers").Run(s.session)
+	iterators := s.session.OpenIterators()
+	c.Assert(iterators, HasLen, 1)
+	c.Assert(iterators[0].Query, Equals, `Table("numbers")`)
+	c.Assert(iterators[0].Stack, Equals, "")
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(s.session.OpenIterators(), HasLen, 0)
+
+	reports := make(chan r.IteratorInfo, 10)
+	report := func(info r.IteratorInfo) { reports <- info }
+	s.session.SetLeakDetector(&r.LeakDetector{MaxAge: 20 * time.Millisecond, Report: report})
+	rows = r.Table("numbers").Run(s.session)
+	var info r.IteratorInfo
+	select {
+	case info = <-reports:
+	case <-time.After(5 * time.Second):
+		c.Fatal("iterator was not reported")
+	}
+	c.Assert(info.Token, Equals, s.server.Queries()[len(s.server.Queries())-1].GetToken())
+	c.Assert(info.Stack, Matches, "(?s).*TestLeakDetector\n\t.*server_test.go:[0-9]+\n.*")
+	c.Assert(info.String(), Matches, `(?s)rethinkdb: Rows iterator for Table\("numbers"\) has been open since .*, it was created at:\n.*`)
+	// an iterator is only reported once
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(reports, HasLen, 0)
+	c.Assert(rows.Close(), IsNil)
+
+	// an iterator that's garbage collected is closed
+	s.session.SetLeakDetector(&r.LeakDetector{CloseLeaked: true, Report: report})
+	func() {
+		r.Table("numbers").Run(s.session)
+	}()
+	for start := time.Now(); len(reports) == 0; {
+		c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	info = <-reports
+	c.Assert(info.GarbageCollected, Equals, true)
+	for start := time.Now(); len(s.session.OpenIterators()) > 0; {
+		c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(s.session.Stats().InUse, Equals, 0)
+	c.Assert(s.lastQuery(), Equals, p.Query_STOP)
+
+	// a Reconnect that fails doesn't leave the leak detector running
+	s.session.SetLeakDetector(&r.LeakDetector{MaxAge: time.Minute})
+	s.session.Close()
+	s.server.Close()
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	c.Assert(s.session.Reconnect(), NotNil)
+	waitForGoroutines(c, before)
+}
+
+func (s *ServerSuite) TestTimeout(c *C) {
+	s.server.On(Read("heroes"), Rows(hero{"Superman"}).After(time.Second))
+	s.session.SetTimeout(10 * time.Millisecond)
+
+	err := r.Table("heroes").Run(s.session).Err()
+	c.Assert(err, NotNil)
+	c.Assert(r.IsTimeout(err), Equals, true)
+	c.Assert(r.IsNetwork(err), Equals, false)
+	c.Assert(r.IsServerError(err), Equals, false)
+
+	s.server.Reset()
+	s.server.On(Any(), Hangup())
+	err = r.Expr(1).Run(s.session).Err()
+	c.Assert(err, NotNil)
+	c.Assert(r.IsNetwork(err), Equals, true)
+	c.Assert(r.IsServerError(err), Equals, false)
+}
+
+// waitForGoroutines waits until there are no more than n goroutines
+func waitForGoroutines(c *C, n int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(runtime.NumGoroutine() <= n, Equals, true)
+}
+
+func (s *ServerSuite) TestFailedConnect(c *C) {
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("no route to host")
+	}
+	opts := r.ConnectOpts{Dial: dial, Pool: r.PoolConfig{IdleTimeout: time.Minute}}
+
+	// the pool's cleaner isn't left running
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		_, err := r.ConnectWithOpts(opts)
+		c.Assert(err, ErrorMatches, ".*no route to host")
+	}
+	waitForGoroutines(c, before)
+}
+
+func (s *ServerSuite) TestRetry(c *C) {
+	// connecting times out once, the query was never sent so it's retried even
+	// though it's a write
+	dials := 0
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		if dials == 2 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.ErrDeadlineExceeded}
+		}
+		return s.server.Dial(ctx, network, address)
+	}
+	opts := r.ConnectOpts{Database: "test", Dial: dial, Pool: r.PoolConfig{MaxIdle: -1}}
+	sess, err := r.ConnectWithOpts(opts)
+	c.Assert(err, IsNil)
+	defer sess.Close()
+	sess.SetRetryPolicy(r.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, Jitter: 5})
+
+	s.server.On(Write("heroes"), JSON(r.Map{"inserted": 1}))
+	err = r.Table("heroes").Insert(hero{"Superman"}).Run(sess).Err()
+	c.Assert(err, IsNil)
+	c.Assert(dials, Equals, 3)
+
+	// a closed session fails straight away instead of waiting to retry
+	sess.SetRetryPolicy(r.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second})
+	sess.Close()
+	start := time.Now()
+	err = r.Expr(1).Run(sess).Err()
+	c.Assert(err, ErrorMatches, ".*session is closed")
+	c.Assert(time.Since(start) < 500*time.Millisecond, Equals, true)
+}
+
+func (s *ServerSuite) TestPipelinedDial(c *C) {
+	// connecting the shared connection hangs until release is closed
+	release := make(chan struct{})
+	var dials sync.WaitGroup
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials.Done()
+		<-release
+		return s.server.Dial(ctx, network, address)
+	}
+	opts := r.ConnectOpts{Database: "test", Dial: dial, Pool: r.PoolConfig{MaxIdle: -1}}
+	dials.Add(1)
+	close(release)
+	sess, err := r.ConnectWithOpts(opts)
+	c.Assert(err, IsNil)
+	defer sess.Close()
+	sess.SetPipelining(true)
+	s.server.On(Any(), JSON(1))
+
+	release = make(chan struct{})
+	dials.Add(1)
+	done := make(chan error)
+	go func() {
+		done <- r.Expr(1).Run(sess).Err()
+	}()
+	dials.Wait()
+
+	// the session isn't locked while connecting, and other queries wait for
+	// the connection only as long as their context allows
+	c.Assert(sess.Stats().Dialing, Equals, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = sess.RunContext(ctx, r.Expr(2)).Err()
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	// queries waiting for the connection share it
+	waiting := make(chan error)
+	go func() {
+		waiting <- r.Expr(3).Run(sess).Err()
+	}()
+	close(release)
+	c.Assert(<-done, IsNil)
+	c.Assert(<-waiting, IsNil)
+	c.Assert(sess.Stats().Open, Equals, 1)
+}
+
+type MemorySuite struct {
+	server  *Server
+	session *r.Session
+}
+
+var _ = Suite(&MemorySuite{})
+
+func (s *MemorySuite) SetUpTest(c *C) {
+	s.server = NewLocalServer()
+	s.server.Handle(Any(), NewDB().Handle)
+
+	var err error
+	s.session, err = r.ConnectWithOpts(r.ConnectOpts{Database: "test", Dial: s.server.Dial})
+	c.Assert(err, IsNil)
+
+	err = r.TableCreate("heroes").Run(s.session).Exec()
+	c.Assert(err, IsNil)
+	heroes := r.List{
+		r.Map{"id": 1, "name": "Superman", "strength": 10, "team": "justice"},
+		r.Map{"id": 2, "name": "Batman", "strength": 4, "team": "justice"},
+		r.Map{"id": 3, "name": "Wolverine", "strength": 7, "team": "x-men"},
+	}
+	var response r.WriteResponse
+	err = r.Table("heroes").Insert(heroes).Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Inserted, Equals, 3)
+}
+
+func (s *MemorySuite) TearDownTest(c *C) {
+	s.session.Close()
+	s.server.Close()
+}
+
+func (s *MemorySuite) TestRead(c *C) {
+	var names []string
+	query := r.Table("heroes").Filter(r.Row.Attr("strength").Gt(5)).OrderBy(r.Desc("strength")).Map(r.Row.Attr("name"))
+	err := query.Run(s.session).Collect(&names)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"Superman", "Wolverine"})
+
+	var h map[string]interface{}
+	err = r.Table("heroes").GetById(2).Run(s.session).One(&h)
+	c.Assert(err, IsNil)
+	c.Assert(h["name"], Equals, "Batman")
+
+	var groups []struct {
+		Group     string
+		Reduction int
+	}
+	err = r.Table("heroes").GroupBy("team", r.Sum("strength")).Run(s.session).One(&groups)
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 2)
+	c.Assert(groups[0].Group, Equals, "justice")
+	c.Assert(groups[0].Reduction, Equals, 14)
+
+	var total int
+	err = r.Table("heroes").Map(r.Row.Attr("strength")).Reduce(0, func(acc, val r.Exp) r.Exp {
+		return acc.Add(val)
+	}).Run(s.session).One(&total)
+	c.Assert(err, IsNil)
+	c.Assert(total, Equals, 21)
+
+	err = r.Table("villains").Run(s.session).Err()
+	c.Assert(err, ErrorMatches, ".*Table `villains` does not exist.*")
+	err = r.Table("heroes").Map(r.Row.Attr("age")).Run(s.session).Err()
+	c.Assert(err, ErrorMatches, "(?s).*is missing attribute \"age\".*")
+}
+
+func (s *MemorySuite) TestList(c *C) {
+	// lists are streams, as the server sends them
+	var databases, tables []string
+	err := r.DbList().Run(s.session).Collect(&databases)
+	c.Assert(err, IsNil)
+	c.Assert(databases, DeepEquals, []string{"test"})
+	err = r.Db("test").TableList().Run(s.session).Collect(&tables)
+	c.Assert(err, IsNil)
+	c.Assert(tables, DeepEquals, []string{"heroes"})
+}
+
+func (s *MemorySuite) TestWrite(c *C) {
+	var response r.WriteResponse
+	err := r.Table("heroes").Filter(r.Row.Attr("team").Eq("justice")).Update(r.Map{"cape": true}).Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Updated, Equals, 2)
+
+	err = r.Table("heroes").GetById(3).Replace(r.Map{"id": 3, "name": "Logan"}).Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Modified, Equals, 1)
+
+	err = r.Table("heroes").Insert(r.Map{"name": "Flash"}).Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.GeneratedKeys, HasLen, 1)
+
+	err = r.Table("heroes").Insert(r.Map{"id": 1, "name": "Clark"}).Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Errors, Equals, 1)
+	c.Assert(response.FirstError, Matches, "Duplicate primary key.*")
+
+	err = r.Table("heroes").GetById(2).Delete().Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Deleted, Equals, 1)
+
+	var heroes []struct {
+		Name string
+		Cape bool
+	}
+	err = r.Table("heroes").Filter(r.Row.Contains("id")).OrderBy("name").Run(s.session).Collect(&heroes)
+	c.Assert(err, IsNil)
+	c.Assert(heroes, HasLen, 3)
+	c.Assert(heroes[0].Name, Equals, "Flash")
+	c.Assert(heroes[1].Name, Equals, "Logan")
+	c.Assert(heroes[2].Cape, Equals, true)
+
+	// reading a table isn't deterministic, so it can't be done atomically
+	update := r.Table("heroes").Update(r.Map{"count": r.Table("heroes").Count()})
+	err = update.Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Errors, Equals, 3)
+	err = update.Atomic(false).Run(s.session).One(&response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Updated, Equals, 3)
+}
+
+func (s *MemorySuite) TestTyped(c *C) {
+	type namedHero struct {
+		Name string `rethinkdb:"name"`
+	}
+	heroes, err := r.CollectAs[namedHero](r.Table("heroes").OrderBy("name"), s.session)
+	c.Assert(err, IsNil)
+	c.Assert(heroes, DeepEquals, []namedHero{{"Batman"}, {"Superman"}, {"Wolverine"}})
+
+	h, err := r.OneAs[namedHero](r.Table("heroes").GetById(3), s.session)
+	c.Assert(err, IsNil)
+	c.Assert(h.Name, Equals, "Wolverine")
+
+	response, err := r.RunWrite(r.Table("heroes").GetById(3).Delete(), s.session)
+	c.Assert(err, IsNil)
+	c.Assert(response.Deleted, Equals, 1)
+
+	_, err = r.CollectAs[namedHero](r.Table("heroes").GetById(1), s.session)
+	c.Assert(err, FitsTypeOf, r.ErrWrongResponseType{})
+	_, err = r.OneAs[namedHero](r.Table("heroes"), s.session)
+	c.Assert(err, FitsTypeOf, r.ErrWrongResponseType{})
+	_, err = r.OneAs[namedHero](r.Table("villains").GetById(1), s.session)
+	c.Assert(err, ErrorMatches, ".*Table `villains` does not exist.*")
+}
+
+type typedVillain struct {
+	Name   string `rethinkdb:"name,primarykey"`
+	Power  int    `rethinkdb:"power"`
+	Lair   string `rethinkdb:"lair,omitempty"`
+	Active bool   `rethinkdb:"active"`
+}
+
+func (s *MemorySuite) TestTypedTable(c *C) {
+	villains := r.TypedTable[typedVillain]("", "villains")
+	c.Assert(villains.PrimaryKey(), Equals, "name")
+	c.Assert(villains.Create(s.session), IsNil)
+
+	response, err := villains.Insert(s.session, typedVillain{Name: "Joker", Power: 3}, typedVillain{Name: "Magneto", Power: 9})
+	c.Assert(err, IsNil)
+	c.Assert(response.Inserted, Equals, 2)
+
+	v, err := villains.Get(s.session, "Magneto")
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, typedVillain{Name: "Magneto", Power: 9})
+	_, err = villains.Get(s.session, "Thanos")
+	c.Assert(err, FitsTypeOf, r.ErrNoSuchRow{})
+
+	response, err = villains.Update(s.session, "Joker", r.Map{"power": r.Row.Attr("power").Add(1)})
+	c.Assert(err, IsNil)
+	c.Assert(response.Updated, Equals, 1)
+	response, err = villains.Replace(s.session, typedVillain{Name: "Magneto", Power: 8, Lair: "Asteroid M"})
+	c.Assert(err, IsNil)
+	c.Assert(response.Modified, Equals, 1)
+
+	strong, err := villains.Filter(s.session, r.Row.Attr("power").Gt(3))
+	c.Assert(err, IsNil)
+	c.Assert(strong, HasLen, 2)
+
+	response, err = villains.Delete(s.session, "Joker")
+	c.Assert(err, IsNil)
+	c.Assert(response.Deleted, Equals, 1)
+
+	var all []typedVillain
+	for v, err := range villains.All(context.Background(), s.session) {
+		c.Assert(err, IsNil)
+		all = append(all, v)
+	}
+	c.Assert(all, DeepEquals, []typedVillain{{Name: "Magneto", Power: 8, Lair: "Asteroid M"}})
+
+	// the handle names its database, whatever the session's database is
+	c.Assert(r.DbCreate("marvel").Run(s.session).Exec(), IsNil)
+	marvel := r.TypedTable[typedVillain]("marvel", "villains")
+	c.Assert(marvel.Create(s.session), IsNil)
+	_, err = marvel.Insert(s.session, typedVillain{Name: "Loki", Power: 6})
+	c.Assert(err, IsNil)
+	v, err = marvel.Get(s.session, "Loki")
+	c.Assert(err, IsNil)
+	c.Assert(v.Power, Equals, 6)
+	_, err = villains.Get(s.session, "Loki")
+	c.Assert(err, FitsTypeOf, r.ErrNoSuchRow{})
+}
+
+func (s *MemorySuite) TestEnsureSchema(c *C) {
+	schema := r.Schema{
+		Databases: []r.DatabaseSchema{
+			{Name: "test", Tables: []r.TableSpec{{Name: "villains", PrimaryKey: "name"}}},
+			{Name: "marvel", Tables: []r.TableSpec{{Name: "heroes"}}},
+		},
+		DryRun: true,
+	}
+	plan, err := s.session.EnsureSchema(schema)
+	c.Assert(err, IsNil)
+	c.Assert(plan.String(), Equals, `create database "marvel"
+create table "villains" in database "test" with primary key "name"
+create table "heroes" in database "marvel"
+table "heroes" in database "test" is not in the schema`)
+	var databases []string
+	err = r.DbList().Run(s.session).Collect(&databases)
+	c.Assert(err, IsNil)
+	c.Assert(databases, DeepEquals, []string{"test"})
+
+	schema.DryRun = false
+	plan, err = s.session.EnsureSchema(schema)
+	c.Assert(err, IsNil)
+	c.Assert(plan.CreateTables, HasLen, 2)
+	var tables []string
+	err = r.Db("marvel").TableList().Run(s.session).Collect(&tables)
+	c.Assert(err, IsNil)
+	c.Assert(tables, DeepEquals, []string{"heroes"})
+	err = r.Table("villains").Insert(r.Map{"name": "Joker"}).Run(s.session).Err()
+	c.Assert(err, IsNil)
+
+	plan, err = s.session.EnsureSchema(schema)
+	c.Assert(err, IsNil)
+	c.Assert(plan.CreateDatabases, HasLen, 0)
+	c.Assert(plan.CreateTables, HasLen, 0)
+	c.Assert(plan.ExtraTables, HasLen, 1)
+}
+
+func (s *MemorySuite) TestBulkInsert(c *C) {
+	heroes := func(ids ...int) iter.Seq[r.Map] {
+		return func(yield func(r.Map) bool) {
+			for _, id := range ids {
+				if !yield(r.Map{"id": id, "name": fmt.Sprint("hero ", id)}) {
+					return
+				}
+			}
+		}
+	}
+	between := func(start, end int) []int {
+		var ids []int
+		for id := start; id < end; id++ {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	// rows without a primary key, from a channel
+	rows := make(chan r.Map)
+	go func() {
+		defer close(rows)
+		for i := 0; i < 25; i++ {
+			rows <- r.Map{"name": fmt.Sprint("anonymous ", i)}
+		}
+	}()
+	response, err := r.BulkInsert(r.Table("heroes"), r.FromChan(rows), s.session, r.BulkOpts{BatchSize: 4, Concurrency: 3})
+	c.Assert(err, IsNil)
+	c.Assert(response.Inserted, Equals, 25)
+	c.Assert(response.GeneratedKeys, HasLen, 25)
+
+	// 1, 2 and 3 already exist
+	opts := r.BulkOpts{BatchSize: 10, Concurrency: 3, OnError: r.ContinueOnError}
+	response, err = r.BulkInsert(r.Table("heroes"), heroes(between(0, 50)...), s.session, opts)
+	c.Assert(err, IsNil)
+	c.Assert(response.Inserted, Equals, 47)
+	c.Assert(response.Errors, Equals, 3)
+	c.Assert(response.FirstError, Matches, "Duplicate primary key.*")
+
+	opts = r.BulkOpts{BatchSize: 10, Concurrency: 1}
+	response, err = r.BulkInsert(r.Table("heroes"), heroes(between(40, 200)...), s.session, opts)
+	c.Assert(err, FitsTypeOf, r.WriteError{})
+	c.Assert(err, ErrorMatches, "rethinkdb: 10 rows failed to be written, the first error was: Duplicate primary key.*")
+	c.Assert(response.Errors, Equals, 10)
+	c.Assert(response.Inserted < 150, Equals, true)
+
+	opts = r.BulkOpts{BatchSize: 3, Overwrite: true}
+	response, err = r.BulkInsert(r.Table("heroes"), heroes(between(0, 10)...), s.session, opts)
+	c.Assert(err, IsNil)
+	c.Assert(response.Errors, Equals, 0)
+
+	var name string
+	err = r.Table("heroes").GetById(1).Attr("name").Run(s.session).One(&name)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "hero 1")
+
+	// a query that fails stops the insert
+	response, err = r.BulkInsert(r.Table("villains"), heroes(between(0, 100)...), s.session, opts)
+	c.Assert(err, ErrorMatches, ".*Table `villains` does not exist.*")
+	c.Assert(response.Inserted, Equals, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = r.BulkInsertContext(ctx, r.Table("heroes"), heroes(between(200, 300)...), s.session, opts)
+	c.Assert(err, Equals, context.Canceled)
+
+	// a source that blocks doesn't hold up cancelling, the row that was
+	// received is never inserted
+	blocked := make(chan r.Map, 1)
+	blocked <- r.Map{"id": 300}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	response, err = r.BulkInsertContext(ctx, r.Table("heroes"), r.FromChan(blocked), s.session, opts)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(response.Inserted, Equals, 0)
+
+	// nor does it hold up stopping after an error
+	blocked = make(chan r.Map, 1)
+	blocked <- r.Map{"id": 1}
+	opts = r.BulkOpts{BatchSize: 1}
+	response, err = r.BulkInsert(r.Table("heroes"), r.FromChan(blocked), s.session, opts)
+	c.Assert(err, FitsTypeOf, r.WriteError{})
+	c.Assert(response.Errors, Equals, 1)
+}
+
+func (s *MemorySuite) TestStrictWrites(c *C) {
+	heroes := []interface{}{
+		r.Map{"name": "Storm"},
+		r.Map{"id": 4, "name": "Cyclops"},
+		r.Map{"name": "Rogue"},
+	}
+	response, err := r.RunWrite(r.Table("heroes").Insert(heroes...), s.session)
+	c.Assert(err, IsNil)
+	c.Assert(response.Err(), IsNil)
+	keys, err := response.GeneratedKeysByRow("id", heroes...)
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{response.GeneratedKeys[0], "", response.GeneratedKeys[1]})
+
+	var storm string
+	err = r.Table("heroes").GetById(keys[0]).Attr("name").Run(s.session).One(&storm)
+	c.Assert(err, IsNil)
+	c.Assert(storm, Equals, "Storm")
+
+	// a single list is inserted row by row
+	list := r.List{r.Map{"name": "Mystique"}, typedVillain{Name: "Joker"}}
+	keys, err = response.GeneratedKeysByRow("id", list)
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, response.GeneratedKeys)
+	_, err = response.GeneratedKeysByRow("id", heroes[:1]...)
+	c.Assert(err, ErrorMatches, "rethinkdb: 1 rows have no primary key, but 2 keys were generated")
+	_, err = response.GeneratedKeysByRow("id", r.Table("heroes").GetById(1))
+	c.Assert(err, ErrorMatches, "rethinkdb: Can't tell whether row 0 has a primary key")
+
+	// one of the rows already exists
+	insert := r.Table("heroes").Insert(r.Map{"id": 1, "name": "Clark"}, r.Map{"id": 5, "name": "Jean"})
+	var total r.WriteResponse
+	err = insert.Run(s.session).One(&total)
+	c.Assert(err, IsNil)
+	c.Assert(total.Errors, Equals, 1)
+	c.Assert(total.Err(), FitsTypeOf, r.WriteError{})
+
+	total.Add(r.WriteResponse{Inserted: 2, Errors: 1, FirstError: "later", GeneratedKeys: []string{"a"}})
+	c.Assert(total.Inserted, Equals, 3)
+	c.Assert(total.Errors, Equals, 2)
+	c.Assert(total.FirstError, Matches, "Duplicate primary key.*")
+	c.Assert(total.GeneratedKeys, DeepEquals, []string{"a"})
+
+	s.session.SetStrictWrites(true)
+	err = r.Table("heroes").Insert(r.Map{"id": 2, "name": "Bruce"}, r.Map{"id": 6, "name": "Scott"}).Run(s.session).One(&response)
+	var writeErr r.WriteError
+	c.Assert(errors.As(err, &writeErr), Equals, true)
+	c.Assert(errors.Is(err, r.WriteError{}), Equals, true)
+	c.Assert(err, ErrorMatches, "rethinkdb: 1 rows failed to be written, the first error was: Duplicate primary key.*")
+	c.Assert(writeErr.Response.Inserted, Equals, 1)
+	c.Assert(response.Inserted, Equals, 1)
+
+	_, err = r.RunWrite(r.Table("heroes").Insert(r.Map{"id": 3}), s.session)
+	c.Assert(err, FitsTypeOf, r.WriteError{})
+
+	// other responses aren't affected
+	var row map[string]interface{}
+	err = r.Table("heroes").GetById(1).Run(s.session).One(&row)
+	c.Assert(err, IsNil)
+
+	// BulkInsert still follows its policy, Cyclops already exists
+	opts := r.BulkOpts{OnError: r.ContinueOnError}
+	response, err = r.BulkInsert(r.Table("heroes"), slices.Values(heroes[1:]), s.session, opts)
+	c.Assert(err, IsNil)
+	c.Assert(response.Inserted, Equals, 1)
+	c.Assert(response.Errors, Equals, 1)
+	response, err = r.BulkInsert(r.Table("heroes"), slices.Values(heroes[1:]), s.session, r.BulkOpts{})
+	c.Assert(err, FitsTypeOf, r.WriteError{})
+	c.Assert(response.Errors, Equals, 1)
+}
@@ -0,0 +1,135 @@
+// Package rethinkprom measures rethinkgo sessions with Prometheus, so you can
+// tell whether queries are slow because of the server, or because they're
+// waiting for connections in the driver's pool.
+//
+// Example usage:
+//
+//  collector := rethinkprom.New()
+//  prometheus.MustRegister(collector)
+//
+//  session, err := r.ConnectWithOpts(r.ConnectOpts{
+//      Address:   "localhost:28015",
+//      Database:  "test",
+//      Collector: collector,
+//  })
+//
+// The metrics are:
+//
+//  rethinkdb_queries_total{type,status}         queries by type (READ, WRITE, META, CONTINUE, STOP) and response status
+//  rethinkdb_query_duration_seconds{type}       histogram of the time taken to answer queries
+//  rethinkdb_message_bytes{direction}           histogram of the size of messages "sent" and "received"
+//  rethinkdb_connections{state}                 connections that are "idle", "in_use" or "dialing"
+//  rethinkdb_open_streams                       Rows iterators holding a connection to read a stream
+//  rethinkdb_leaked_streams_total               Rows iterators garbage collected without being closed
+//
+// Queries that failed without a response from the server, for instance
+// because of a network error, have the status "NO_RESPONSE".
+package rethinkprom
+
+import (
+	r "github.com/christopherhesse/rethinkgo"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Collector is both a rethinkgo Collector and a Prometheus Collector, it can
+// be shared by several sessions.
+type Collector struct {
+	queries      *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	messageBytes *prometheus.HistogramVec
+	connections  *prometheus.GaugeVec
+	streams      prometheus.Gauge
+	leaked       prometheus.Counter
+}
+
+// New creates a Collector, which has to be registered with a Prometheus
+// registry to be scraped.
+func New() *Collector {
+	return &Collector{
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rethinkdb_queries_total",
+			Help: "Number of queries sent to the server, by type of query and response status.",
+		}, []string{"type", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rethinkdb_query_duration_seconds",
+			Help:    "Time taken for the server to answer queries, by type of query.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"type"}),
+		messageBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rethinkdb_message_bytes",
+			Help:    "Size of the messages sent to and received from the server.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"direction"}),
+		connections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "rethinkdb_connections",
+			Help: "Number of connections to the server, by state.",
+		}, []string{"state"}),
+		streams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "rethinkdb_open_streams",
+			Help: "Number of Rows iterators holding a connection to read a stream.",
+		}),
+		leaked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rethinkdb_leaked_streams_total",
+			Help: "Number of Rows iterators that were garbage collected without being closed.",
+		}),
+	}
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{c.queries, c.duration, c.messageBytes, c.connections, c.streams, c.leaked}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// QueryDone implements rethinkgo.Collector.
+func (c *Collector) QueryDone(queryType p.Query_QueryType, status p.Response_StatusCode, err error, duration time.Duration) {
+	statusLabel := "NO_RESPONSE"
+	if err == nil || r.IsServerError(err) {
+		statusLabel = status.String()
+	}
+	c.queries.WithLabelValues(queryType.String(), statusLabel).Inc()
+	c.duration.WithLabelValues(queryType.String()).Observe(duration.Seconds())
+}
+
+// MessageSent implements rethinkgo.Collector.
+func (c *Collector) MessageSent(bytes int) {
+	c.messageBytes.WithLabelValues("sent").Observe(float64(bytes))
+}
+
+// MessageReceived implements rethinkgo.Collector.
+func (c *Collector) MessageReceived(bytes int) {
+	c.messageBytes.WithLabelValues("received").Observe(float64(bytes))
+}
+
+// ConnsChanged implements rethinkgo.Collector.
+func (c *Collector) ConnsChanged(idle, inUse, dialing int) {
+	c.connections.WithLabelValues("idle").Add(float64(idle))
+	c.connections.WithLabelValues("in_use").Add(float64(inUse))
+	c.connections.WithLabelValues("dialing").Add(float64(dialing))
+}
+
+// StreamsChanged implements rethinkgo.Collector.
+func (c *Collector) StreamsChanged(delta int) {
+	c.streams.Add(float64(delta))
+}
+
+// StreamLeaked implements rethinkgo.Collector.
+func (c *Collector) StreamLeaked() {
+	c.leaked.Inc()
+}
+
+var _ r.Collector = (*Collector)(nil)
@@ -0,0 +1,95 @@
+package rethinkprom
+
+import (
+	r "github.com/christopherhesse/rethinkgo"
+	"github.com/christopherhesse/rethinkgo/rethinkgotest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "launchpad.net/gocheck"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PromSuite struct {
+	server    *rethinkgotest.Server
+	session   *r.Session
+	collector *Collector
+}
+
+var _ = Suite(&PromSuite{})
+
+func (s *PromSuite) SetUpTest(c *C) {
+	var err error
+	s.server, err = rethinkgotest.NewServer()
+	c.Assert(err, IsNil)
+	s.collector = New()
+	s.session, err = r.ConnectWithOpts(r.ConnectOpts{
+		Address:   s.server.Address(),
+		Database:  "test",
+		Collector: s.collector,
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *PromSuite) TearDownTest(c *C) {
+	s.session.Close()
+	s.server.Close()
+}
+
+func (s *PromSuite) connections(state string) float64 {
+	return testutil.ToFloat64(s.collector.connections.WithLabelValues(state))
+}
+
+func (s *PromSuite) TestQueries(c *C) {
+	registry := prometheus.NewPedanticRegistry()
+	c.Assert(registry.Register(s.collector), IsNil)
+
+	s.server.On(rethinkgotest.Read("numbers"), rethinkgotest.Rows(1, 2, 3, 4, 5).Chunks(2))
+	s.server.On(rethinkgotest.Read("heroes"), rethinkgotest.RuntimeError("Table `heroes` does not exist."))
+
+	var numbers []int
+	c.Assert(r.Table("numbers").Run(s.session).Collect(&numbers), IsNil)
+	c.Assert(r.Table("heroes").Run(s.session).Err(), NotNil)
+
+	c.Assert(testutil.ToFloat64(s.collector.queries.WithLabelValues("READ", "SUCCESS_PARTIAL")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(s.collector.queries.WithLabelValues("CONTINUE", "SUCCESS_PARTIAL")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(s.collector.queries.WithLabelValues("CONTINUE", "SUCCESS_STREAM")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(s.collector.queries.WithLabelValues("READ", "RUNTIME_ERROR")), Equals, 1.0)
+	c.Assert(testutil.CollectAndCount(s.collector, "rethinkdb_query_duration_seconds"), Equals, 2)
+	c.Assert(testutil.CollectAndCount(s.collector, "rethinkdb_message_bytes"), Equals, 2)
+
+	// the connection made by Connect() is back in the pool
+	c.Assert(s.connections("idle"), Equals, 1.0)
+	c.Assert(s.connections("in_use"), Equals, 0.0)
+	c.Assert(s.connections("dialing"), Equals, 0.0)
+
+	// the scrape is consistent with the descriptions
+	_, err := registry.Gather()
+	c.Assert(err, IsNil)
+}
+
+func (s *PromSuite) TestStreams(c *C) {
+	s.server.On(rethinkgotest.Read("numbers"), rethinkgotest.Rows(1, 2, 3, 4, 5).Chunks(2))
+
+	rows := r.Table("numbers").Run(s.session)
+	c.Assert(testutil.ToFloat64(s.collector.streams), Equals, 1.0)
+	c.Assert(s.connections("in_use"), Equals, 1.0)
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(testutil.ToFloat64(s.collector.streams), Equals, 0.0)
+	c.Assert(s.connections("in_use"), Equals, 0.0)
+
+	// an iterator that is never closed keeps its connection
+	func() {
+		r.Table("numbers").Run(s.session)
+	}()
+	for start := time.Now(); testutil.ToFloat64(s.collector.leaked) == 0; {
+		c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(testutil.ToFloat64(s.collector.streams), Equals, 1.0)
+	c.Assert(s.connections("in_use"), Equals, float64(s.session.Stats().InUse))
+}
@@ -0,0 +1,140 @@
+package rethinkgo
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy tells a session to run a query again if it fails because of a
+// network error, for instance if the connection is reset while waiting for the
+// response.  Use it with Session.SetRetryPolicy().
+//
+// A query is only run again if running it twice is harmless: read queries
+// (Exp), .DbList() and .TableList().  Write queries are only run again if they
+// have been marked with .Idempotent(true).  Any query is run again if it
+// failed before it was sent, e.g. because the server could not be reached or
+// connecting to it timed out.
+//
+// Only the initial request is retried, if the connection fails while a Rows
+// iterator is fetching more results, the iterator returns the error.
+//
+// The wait between attempts starts at InitialBackoff and is multiplied by
+// Multiplier after each attempt, up to MaxBackoff.  Each wait is randomly
+// shortened by up to Jitter (a fraction between 0 and 1) of its length, so
+// that many clients don't all retry at once.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a query is run, including the
+	// first time.  Zero or one means queries are not retried.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, defaults to 50ms
+	InitialBackoff time.Duration
+	// MaxBackoff is the longest wait between attempts, defaults to 5s
+	MaxBackoff time.Duration
+	// Multiplier is the factor the wait grows by after each attempt, defaults
+	// to 2
+	Multiplier float64
+	// Jitter is the fraction of each wait that is randomized, values outside
+	// 0 to 1 are treated as the nearest of the two
+	Jitter float64
+}
+
+// SetRetryPolicy causes queries run on this session to be run again if they
+// fail because of a network error, see RetryPolicy for details.  Use the zero
+// RetryPolicy to disable retries, the default.
+//
+// Example usage:
+//
+//  sess.SetRetryPolicy(r.RetryPolicy{MaxAttempts: 3, Jitter: 0.2})
+func (s *Session) SetRetryPolicy(policy RetryPolicy) {
+	s.retryPolicy = policy
+}
+
+// Idempotent marks a write query as safe to run more than once, so that it
+// can be run again by the session's RetryPolicy if it fails because of a
+// network error.  For example, an .Insert() with .Overwrite(true), or a
+// .Delete(), would have the same effect if run twice.
+//
+// Example usage:
+//
+//  row := r.Map{"id": 1, "name": "Thing"}
+//  err := r.Table("heroes").Insert(row).Overwrite(true).Idempotent(true).Run(session).Err()
+func (q WriteQuery) Idempotent(idempotent bool) WriteQuery {
+	q.idempotent = idempotent
+	return q
+}
+
+// retrySafe returns true if a query can be run again even though the server
+// may have already run it.
+func retrySafe(query Query) bool {
+	switch q := query.(type) {
+	case Exp:
+		return true
+	case MetaQuery:
+		switch q.query.(type) {
+		case listDatabasesQuery, tableListQuery:
+			return true
+		}
+	case WriteQuery:
+		return q.idempotent
+	}
+	return false
+}
+
+// shouldRetry decides if a query should be run again after attempt number
+// `attempt` failed with err.  `sent` is false if the query never made it onto
+// the network, in which case it's safe to retry whatever the error was, such as
+// a timeout while connecting, unless it can't go away, like the session being
+// closed.
+func (policy RetryPolicy) shouldRetry(attempt int, query Query, sent bool, err error) bool {
+	if err == nil || attempt >= policy.MaxAttempts || errors.Is(err, errSessionClosed) {
+		return false
+	}
+	if !sent {
+		return true
+	}
+	return isNetworkError(err) && retrySafe(query)
+}
+
+// jitter returns policy.Jitter limited to between 0 and 1
+func (policy RetryPolicy) jitter() float64 {
+	return min(max(policy.Jitter, 0), 1)
+}
+
+// wait sleeps before attempt number `attempt` + 1, returning early with an
+// error if ctx is done.
+func (policy RetryPolicy) wait(ctx context.Context, attempt int) error {
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = 50 * time.Millisecond
+	}
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Second
+	}
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := float64(backoff)
+	for i := 1; i < attempt && delay < float64(maxBackoff); i++ {
+		delay *= multiplier
+	}
+	if delay > float64(maxBackoff) {
+		delay = float64(maxBackoff)
+	}
+	if jitter := policy.jitter(); jitter > 0 {
+		delay -= delay * jitter * rand.Float64()
+	}
+
+	timer := time.NewTimer(time.Duration(delay))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
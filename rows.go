@@ -2,6 +2,7 @@ package rethinkgo
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -37,9 +38,14 @@ import (
 //
 // All three of these methods will return errors if used on a query response
 // that does not match the expected type (ErrWrongResponseType).
+//
+// Each method has a variant taking a context.Context, e.g. .NextContext(ctx,
+// &dest), that gives up waiting for the server once the context is done.
+// Without one, the context passed to Session.RunContext() is used.
 type Rows struct {
 	session  *Session
 	conn     *connection
+	ctx      context.Context
 	closed   bool
 	buffer   []string
 	current  *string
@@ -47,32 +53,75 @@ type Rows struct {
 	lasterr  error
 	token    int64
 	status   p.Response_StatusCode
+	prefetch *prefetcher
+	stream   *streamState
+	// query is the query that was run, see locateError()
+	query        Query
+	buildContext buildContext
+}
+
+// runContext returns the context this iterator was created with
+func (rows *Rows) runContext() context.Context {
+	if rows.ctx == nil {
+		return context.Background()
+	}
+	return rows.ctx
 }
 
 // continueQuery creates a query that will cause this query to continue
-func (rows *Rows) continueQuery() error {
+func (rows *Rows) continueQuery(ctx context.Context) error {
+	return rows.applyChunk(ctx, fetchChunk(ctx, rows.session, rows.conn, rows.token, rows.query))
+}
+
+// chunk is the result of asking the server for more rows of a stream
+type chunk struct {
+	buffer   []string
+	complete bool
+	err      error
+}
+
+// fetchChunk gets the next chunk of a stream from the server, it doesn't
+// modify the iterator, so it can be run in the background, see prefetch.go
+func fetchChunk(ctx context.Context, session *Session, conn *connection, token int64, query Query) chunk {
 	queryProto := &p.Query{
 		Type:  p.Query_CONTINUE.Enum(),
-		Token: proto.Int64(rows.token),
+		Token: proto.Int64(token),
 	}
-	buffer, status, err := rows.conn.executeQuery(queryProto, rows.session.timeout)
+	buffer, status, err := session.execute(ctx, conn, queryProto, query)
 	if err != nil {
-		return err
+		return chunk{err: err}
 	}
 
 	switch status {
 	case p.Response_SUCCESS_PARTIAL:
 		// continuation of a stream of rows
-		rows.buffer = buffer
+		return chunk{buffer: buffer}
 	case p.Response_SUCCESS_STREAM:
 		// end of a stream of rows, there's no more after this
-		rows.buffer = buffer
+		return chunk{buffer: buffer, complete: true}
+	}
+	return chunk{err: fmt.Errorf("rethinkdb: Unexpected status code: %v", status)}
+}
+
+// applyChunk updates the iterator with a chunk from fetchChunk, ctx is the
+// context the chunk was fetched with
+func (rows *Rows) applyChunk(ctx context.Context, c chunk) error {
+	if c.err != nil {
+		rows.session.hostFailed(rows.conn, c.err)
+		if abandoned(ctx, c.err) || isNetworkError(c.err) {
+			rows.abandonConn()
+		}
+		return rows.buildContext.locateError(rows.query, c.err)
+	}
+
+	rows.buffer = c.buffer
+	if c.complete {
 		rows.complete = true
-		// since we won't be needing this connection anymore, we can close the
-		// iterator, if the user closes it again, it won't hurt it
-		rows.Close()
-	default:
-		return fmt.Errorf("rethinkdb: Unexpected status code: %v", status)
+		// since we won't be needing this connection anymore, we can return it to
+		// the pool, the iterator is closed once the rest of the buffer is used
+		rows.session.putConn(rows.conn)
+		rows.conn = nil
+		rows.releaseStream()
 	}
 	return nil
 }
@@ -92,6 +141,79 @@ func (rows *Rows) continueQuery() error {
 //      ...
 //  }
 func (rows *Rows) Next(dest interface{}) bool {
+	return rows.NextContext(rows.runContext(), dest)
+}
+
+// NextContext is like Next, but stops waiting for more rows from the server
+// once ctx is done.  In that case it returns false, .Err() returns ctx.Err()
+// and the iterator is closed, stopping the stream on the server.
+//
+// Example usage:
+//
+//  for rows.NextContext(ctx, &hero) {
+//      fmt.Println("hero:", hero)
+//  }
+func (rows *Rows) NextContext(ctx context.Context, dest interface{}) bool {
+	if !rows.advance(ctx) {
+		return false
+	}
+
+	// the driver's decoding doesn't keep the row, and decode() copies it for
+	// anything else, so it doesn't need to be copied here
+	err := rows.session.decode(stringBytes(*rows.current), dest)
+	if err != nil {
+		rows.lasterr = err
+		return false
+	}
+	return true
+}
+
+// NextRaw moves the iterator forward by one row like Next, but returns the
+// row's JSON as sent by the server, instead of decoding it.
+//
+// Example usage:
+//
+//  rows := r.Table("heroes").Run(session)
+//  defer rows.Close()
+//  for {
+//      row, ok := rows.NextRaw()
+//      if !ok {
+//          break
+//      }
+//      w.Write(row)
+//  }
+//  if rows.Err() != nil {
+//      ...
+//  }
+func (rows *Rows) NextRaw() (json.RawMessage, bool) {
+	return rows.NextRawContext(rows.runContext(), nil)
+}
+
+// NextRawContext is like NextRaw, but stops waiting for more rows from the
+// server once ctx is done, see NextContext.  The row is copied into buf,
+// which is grown if needed, so that a buffer can be reused for every row.
+//
+// Example usage:
+//
+//  var buf json.RawMessage
+//  for {
+//      var ok bool
+//      buf, ok = rows.NextRawContext(ctx, buf)
+//      if !ok {
+//          break
+//      }
+//      w.Write(buf)
+//  }
+func (rows *Rows) NextRawContext(ctx context.Context, buf []byte) (json.RawMessage, bool) {
+	if !rows.advance(ctx) {
+		return nil, false
+	}
+	return append(buf[:0], *rows.current...), true
+}
+
+// advance moves the iterator to the next row, which is left in rows.current
+// for the caller to decode
+func (rows *Rows) advance(ctx context.Context) bool {
 	if rows.closed {
 		return false
 	}
@@ -99,33 +221,41 @@ func (rows *Rows) Next(dest interface{}) bool {
 		return false
 	}
 
-	if len(rows.buffer) == 0 {
+	for len(rows.buffer) == 0 && rows.lasterr == nil {
 		// we're out of results, may need to fetch some more
 		if rows.complete {
 			// no more rows left to fetch
 			rows.lasterr = io.EOF
+		} else if err := ctx.Err(); err != nil {
+			rows.lasterr = err
+		} else if rows.prefetch != nil {
+			// more rows are already on their way
+			rows.lasterr = rows.prefetch.next(ctx, rows)
 		} else {
 			// more rows to get, fetch 'em
-			err := rows.continueQuery()
+			err := rows.continueQuery(ctx)
 			if err != nil {
 				rows.lasterr = err
 			}
 		}
-	}
 
-	if len(rows.buffer) > 0 {
-		rows.current = &rows.buffer[0]
-		rows.buffer = rows.buffer[1:len(rows.buffer)]
-		err := json.Unmarshal([]byte(*rows.current), dest)
-		if err != nil {
-			rows.lasterr = err
+		if rows.lasterr != nil && rows.lasterr == ctx.Err() {
+			// the caller isn't interested in the rest of the stream
+			rows.Close()
+			return false
 		}
 	}
 
 	if rows.lasterr == io.EOF {
 		rows.closed = true
 	}
-	return rows.lasterr == nil
+	if rows.lasterr != nil {
+		return false
+	}
+
+	rows.current = &rows.buffer[0]
+	rows.buffer = rows.buffer[1:len(rows.buffer)]
+	return true
 }
 
 // Err returns the last error encountered, for example, a network error while
@@ -152,6 +282,12 @@ func (rows *Rows) Err() error {
 //  var result []interface{}
 //  err := r.Table("heroes").Run(session).Collect(&result)
 func (rows *Rows) Collect(slice interface{}) error {
+	return rows.CollectContext(rows.runContext(), slice)
+}
+
+// CollectContext is like Collect, but gives up once ctx is done, returning
+// ctx.Err().
+func (rows *Rows) CollectContext(ctx context.Context, slice interface{}) error {
 	if rows.Err() != nil {
 		return rows.Err()
 	}
@@ -167,7 +303,7 @@ func (rows *Rows) Collect(slice interface{}) error {
 	}
 
 	if rows.status != p.Response_SUCCESS_PARTIAL && rows.status != p.Response_SUCCESS_STREAM {
-		return ErrWrongResponseType{}
+		return ErrWrongResponseType{response: statusResponse(rows.status, rows.token)}
 	}
 
 	// create a new slice to hold the results
@@ -175,11 +311,15 @@ func (rows *Rows) Collect(slice interface{}) error {
 	// create a new element of the kind that the slice holds so we can scan
 	// into it
 	elemValue := reflect.New(sliceValue.Type().Elem())
-	for rows.Next(elemValue.Interface()) {
+	zeroValue := reflect.Zero(elemValue.Elem().Type())
+	for rows.NextContext(ctx, elemValue.Interface()) {
 		if rows.Err() != nil {
 			return rows.Err()
 		}
 		newSliceValue = reflect.Append(newSliceValue, elemValue.Elem())
+		// start each row from scratch, so maps and pointers in one element
+		// aren't shared with the next
+		elemValue.Elem().Set(zeroValue)
 	}
 
 	if rows.Err() != nil {
@@ -197,23 +337,39 @@ func (rows *Rows) Collect(slice interface{}) error {
 //  var result interface{}
 //  err := r.Table("villains").Get("Galactus", "name").Run(session).One(&result)
 func (rows *Rows) One(row interface{}) error {
+	return rows.OneContext(rows.runContext(), row)
+}
+
+// OneContext is like One, but returns ctx.Err() if ctx is done.
+func (rows *Rows) OneContext(ctx context.Context, row interface{}) error {
 	if rows.Err() != nil {
 		return rows.Err()
 	}
 
+	if err := ctx.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+
 	if rows.status != p.Response_SUCCESS_JSON {
-		return ErrWrongResponseType{}
+		return ErrWrongResponseType{response: statusResponse(rows.status, rows.token)}
 	}
 
 	if rows.lasterr == io.EOF {
-		return ErrNoSuchRow{}
+		return ErrNoSuchRow{response: statusResponse(rows.status, rows.token)}
 	}
 
-	rows.Next(row)
+	rows.NextContext(ctx, row)
 
 	rows.Close()
 
-	return rows.Err()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	if response, ok := row.(*WriteResponse); ok && rows.session.strictWrites {
+		return response.Err()
+	}
+	return nil
 }
 
 // Exec is for queries that return no result.  For instance, creating a table.
@@ -222,14 +378,23 @@ func (rows *Rows) One(row interface{}) error {
 //
 //  err := r.TableCreate("villains").Run(session).Exec()
 func (rows *Rows) Exec() error {
+	return rows.ExecContext(rows.runContext())
+}
+
+// ExecContext is like Exec, but returns ctx.Err() if ctx is done.
+func (rows *Rows) ExecContext(ctx context.Context) error {
 	if rows.Err() != nil {
 		return rows.Err()
 	}
 
 	rows.Close()
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if rows.status != p.Response_SUCCESS_EMPTY {
-		return ErrWrongResponseType{}
+		return ErrWrongResponseType{response: statusResponse(rows.status, rows.token)}
 	}
 
 	return nil
@@ -252,6 +417,9 @@ func (rows *Rows) Exec() error {
 //  }
 func (rows *Rows) Close() (err error) {
 	if !rows.closed {
+		if rows.prefetch != nil {
+			rows.prefetch.stop(rows)
+		}
 		if rows.conn != nil {
 			// if rows.conn is not nil, that means this is a stream response
 
@@ -262,13 +430,28 @@ func (rows *Rows) Close() (err error) {
 					Type:  p.Query_STOP.Enum(),
 					Token: proto.Int64(rows.token),
 				}
-				_, _, err = rows.conn.executeQuery(queryProto, rows.session.timeout)
+				_, _, err = rows.session.execute(context.Background(), rows.conn, queryProto, rows.query)
 			}
 
 			// return this connection to the pool
 			rows.session.putConn(rows.conn)
+			rows.releaseStream()
 		}
 		rows.closed = true
 	}
 	return
 }
+
+// abandonConn is called when we stopped waiting for a response on this
+// iterator's connection, or the connection failed, a regular connection can't
+// be used again after that.
+// Closing the connection also discards the stream on the server, so no stop
+// query is needed.
+func (rows *Rows) abandonConn() {
+	if !rows.conn.multiplexed {
+		rows.session.discardConn(rows.conn)
+		rows.conn = nil
+		rows.complete = true
+		rows.releaseStream()
+	}
+}
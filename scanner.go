@@ -0,0 +1,325 @@
+package rethinkgo
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// scanner reads the JSON document for a row one value at a time, so that rows
+// can be decoded straight into Go values without building a tree of maps and
+// slices first.
+type scanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *scanner) syntaxError(what string) error {
+	return fmt.Errorf("rethinkdb: Invalid JSON, %v at offset %v", what, s.pos)
+}
+
+// peek skips whitespace and returns the next byte, or 0 at the end of the data
+func (s *scanner) peek() byte {
+	for s.pos < len(s.data) {
+		switch c := s.data[s.pos]; c {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return c
+		}
+	}
+	return 0
+}
+
+// expect consumes the byte c, which must come next
+func (s *scanner) expect(c byte) error {
+	if s.peek() != c {
+		return s.syntaxError(fmt.Sprintf("expected %q", c))
+	}
+	s.pos++
+	return nil
+}
+
+// literal consumes one of true, false and null
+func (s *scanner) literal(word string) error {
+	s.peek()
+	end := s.pos + len(word)
+	if end > len(s.data) || string(s.data[s.pos:end]) != word {
+		return s.syntaxError("invalid literal")
+	}
+	s.pos = end
+	return nil
+}
+
+// open consumes the bracket that starts an array or object, and reports
+// whether there are any elements before the closing bracket
+func (s *scanner) open(opening, closing byte) (bool, error) {
+	if err := s.expect(opening); err != nil {
+		return false, err
+	}
+	if s.peek() == closing {
+		s.pos++
+		return false, nil
+	}
+	return true, nil
+}
+
+// more consumes what follows an element of an array or object, and reports
+// whether there's another element
+func (s *scanner) more(closing byte) (bool, error) {
+	switch s.peek() {
+	case ',':
+		s.pos++
+		return true, nil
+	case closing:
+		s.pos++
+		return false, nil
+	}
+	return false, s.syntaxError(fmt.Sprintf("expected ',' or %q", closing))
+}
+
+// key reads the name of an object's attribute and the colon after it
+func (s *scanner) key() ([]byte, error) {
+	if s.peek() != '"' {
+		return nil, s.syntaxError("expected an attribute name")
+	}
+	key, err := s.str()
+	if err != nil {
+		return nil, err
+	}
+	return key, s.expect(':')
+}
+
+// str reads a string and returns its contents.  Unless the string has escapes,
+// the result is part of s.data, so it must be copied to be kept.
+func (s *scanner) str() ([]byte, error) {
+	if err := s.expect('"'); err != nil {
+		return nil, err
+	}
+	start := s.pos
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return s.data[start : s.pos-1], nil
+		case c == '\\' || c < ' ':
+			return s.unescape(start)
+		case c < utf8.RuneSelf:
+			s.pos++
+		default:
+			r, size := utf8.DecodeRune(s.data[s.pos:])
+			if r == utf8.RuneError && size == 1 {
+				return s.unescape(start)
+			}
+			s.pos += size
+		}
+	}
+	return nil, s.syntaxError("unterminated string")
+}
+
+// unescape finishes reading a string that started at start, replacing escapes,
+// and invalid UTF-8 the same as encoding/json does
+func (s *scanner) unescape(start int) ([]byte, error) {
+	out := make([]byte, s.pos-start, s.pos-start+16)
+	copy(out, s.data[start:s.pos])
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return out, nil
+		case c < ' ':
+			return nil, s.syntaxError("control character in string")
+		case c == '\\':
+			s.pos++
+			if s.pos == len(s.data) {
+				return nil, s.syntaxError("unterminated string")
+			}
+			c = s.data[s.pos]
+			s.pos++
+			switch c {
+			case '"', '\\', '/':
+				out = append(out, c)
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'u':
+				r, ok := s.hex()
+				if !ok {
+					return nil, s.syntaxError("invalid \\u escape")
+				}
+				if utf16.IsSurrogate(r) {
+					// the second half of the pair must follow, otherwise the
+					// first half is replaced and the next escape read as usual
+					replaced := true
+					if s.pos+1 < len(s.data) && s.data[s.pos] == '\\' && s.data[s.pos+1] == 'u' {
+						s.pos += 2
+						r2, ok := s.hex()
+						if !ok {
+							return nil, s.syntaxError("invalid \\u escape")
+						}
+						if pair := utf16.DecodeRune(r, r2); pair != unicode.ReplacementChar {
+							r, replaced = pair, false
+						} else {
+							s.pos -= 6
+						}
+					}
+					if replaced {
+						r = unicode.ReplacementChar
+					}
+				}
+				out = utf8.AppendRune(out, r)
+			default:
+				return nil, s.syntaxError("invalid escape")
+			}
+		case c < utf8.RuneSelf:
+			out = append(out, c)
+			s.pos++
+		default:
+			r, size := utf8.DecodeRune(s.data[s.pos:])
+			out = utf8.AppendRune(out, r)
+			s.pos += size
+		}
+	}
+	return nil, s.syntaxError("unterminated string")
+}
+
+// hex reads the four hex digits of a \u escape
+func (s *scanner) hex() (rune, bool) {
+	if s.pos+4 > len(s.data) {
+		return 0, false
+	}
+	var r rune
+	for _, c := range s.data[s.pos : s.pos+4] {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c = c - 'a' + 10
+		case 'A' <= c && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		r = r<<4 | rune(c)
+	}
+	s.pos += 4
+	return r, true
+}
+
+// number reads a number and returns its text
+func (s *scanner) number() ([]byte, error) {
+	s.peek()
+	start := s.pos
+	if s.pos < len(s.data) && s.data[s.pos] == '-' {
+		s.pos++
+	}
+	if s.pos < len(s.data) && s.data[s.pos] == '0' {
+		s.pos++
+	} else if s.digits() == 0 {
+		return nil, s.syntaxError("invalid number")
+	}
+	if s.pos < len(s.data) && s.data[s.pos] == '.' {
+		s.pos++
+		if s.digits() == 0 {
+			return nil, s.syntaxError("invalid number")
+		}
+	}
+	if s.pos < len(s.data) && (s.data[s.pos] == 'e' || s.data[s.pos] == 'E') {
+		s.pos++
+		if s.pos < len(s.data) && (s.data[s.pos] == '+' || s.data[s.pos] == '-') {
+			s.pos++
+		}
+		if s.digits() == 0 {
+			return nil, s.syntaxError("invalid number")
+		}
+	}
+	return s.data[start:s.pos], nil
+}
+
+func (s *scanner) digits() int {
+	start := s.pos
+	for s.pos < len(s.data) && '0' <= s.data[s.pos] && s.data[s.pos] <= '9' {
+		s.pos++
+	}
+	return s.pos - start
+}
+
+// skip reads the next value without decoding it
+func (s *scanner) skip() error {
+	switch s.peek() {
+	case '"':
+		_, err := s.str()
+		return err
+	case '{':
+		more, err := s.open('{', '}')
+		for err == nil && more {
+			if _, err = s.key(); err != nil {
+				break
+			}
+			if err = s.skip(); err != nil {
+				break
+			}
+			more, err = s.more('}')
+		}
+		return err
+	case '[':
+		more, err := s.open('[', ']')
+		for err == nil && more {
+			if err = s.skip(); err != nil {
+				break
+			}
+			more, err = s.more(']')
+		}
+		return err
+	case 't':
+		return s.literal("true")
+	case 'f':
+		return s.literal("false")
+	case 'n':
+		return s.literal("null")
+	}
+	_, err := s.number()
+	return err
+}
+
+// parseInt parses a number without allocating, ok is false if it needs
+// strconv, for instance because it has a fraction or an exponent, or is long
+func parseInt(text []byte) (n int64, ok bool) {
+	negative := len(text) > 0 && text[0] == '-'
+	if negative {
+		text = text[1:]
+	}
+	u, ok := parseUint(text)
+	if !ok {
+		return 0, false
+	}
+	if negative {
+		return -int64(u), true
+	}
+	return int64(u), true
+}
+
+// parseUint is parseInt for numbers that must not be negative, at most 18
+// digits long so that they can't overflow
+func parseUint(text []byte) (n uint64, ok bool) {
+	if len(text) == 0 || len(text) > 18 {
+		return 0, false
+	}
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	return n, true
+}
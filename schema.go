@@ -0,0 +1,186 @@
+package rethinkgo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Schema describes the databases and tables a program needs, see
+// Session.EnsureSchema().
+type Schema struct {
+	Databases []DatabaseSchema
+	// DryRun causes EnsureSchema to only work out what it would change, without
+	// changing anything
+	DryRun bool
+}
+
+// DatabaseSchema describes a database and the tables it should have.
+type DatabaseSchema struct {
+	Name   string
+	Tables []TableSpec
+}
+
+// SchemaTable is a table in a SchemaPlan.
+type SchemaTable struct {
+	Database string
+	Spec     TableSpec
+}
+
+// SchemaPlan lists the differences between a Schema and the databases and
+// tables on the server, by name, see Session.EnsureSchema().
+type SchemaPlan struct {
+	// CreateDatabases are the databases that are missing
+	CreateDatabases []string
+	// CreateTables are the tables that are missing
+	CreateTables []SchemaTable
+	// ExtraTables are tables in the schema's databases that aren't in the
+	// schema, these are left alone
+	ExtraTables []SchemaTable
+}
+
+// Empty returns true if the server already matches the schema.
+func (plan *SchemaPlan) Empty() bool {
+	return len(plan.CreateDatabases) == 0 && len(plan.CreateTables) == 0 && len(plan.ExtraTables) == 0
+}
+
+// String describes the plan, one change per line.
+func (plan *SchemaPlan) String() string {
+	var lines []string
+	for _, name := range plan.CreateDatabases {
+		lines = append(lines, fmt.Sprintf("create database %q", name))
+	}
+	for _, table := range plan.CreateTables {
+		line := fmt.Sprintf("create table %q in database %q", table.Spec.Name, table.Database)
+		if table.Spec.PrimaryKey != "" {
+			line += fmt.Sprintf(" with primary key %q", table.Spec.PrimaryKey)
+		}
+		lines = append(lines, line)
+	}
+	for _, table := range plan.ExtraTables {
+		lines = append(lines, fmt.Sprintf("table %q in database %q is not in the schema", table.Spec.Name, table.Database))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// EnsureSchema creates any databases and tables in schema that don't exist on
+// the server yet, and returns a plan describing what was missing, including
+// tables that exist but aren't in the schema.  With schema.DryRun, nothing is
+// created.
+//
+// Databases or tables created at the same time by another session aren't
+// treated as errors, so a number of programs can share a schema.
+//
+// Only the names of databases and tables are compared.  A table that exists
+// with a different PrimaryKey, PrimaryDatacenter or CacheSize from its
+// TableSpec isn't reported, because this version of the protocol can only list
+// the names of tables, not read their configuration.
+//
+// Example usage:
+//
+//  schema := r.Schema{Databases: []r.DatabaseSchema{{
+//      Name: "marvel",
+//      Tables: []r.TableSpec{
+//          {Name: "heroes", PrimaryKey: "name"},
+//          {Name: "villains"},
+//      },
+//  }}}
+//  plan, err := session.EnsureSchema(schema)
+//
+// Example dry run:
+//
+//  schema.DryRun = true
+//  plan, err := session.EnsureSchema(schema)
+//  fmt.Println(plan)
+//
+// Example output:
+//
+//  create database "marvel"
+//  create table "heroes" in database "marvel" with primary key "name"
+//  create table "villains" in database "marvel"
+func (s *Session) EnsureSchema(schema Schema) (*SchemaPlan, error) {
+	return s.EnsureSchemaContext(context.Background(), schema)
+}
+
+// EnsureSchemaContext is like EnsureSchema, but gives up once ctx is done,
+// returning ctx.Err().
+func (s *Session) EnsureSchemaContext(ctx context.Context, schema Schema) (*SchemaPlan, error) {
+	plan, err := s.planSchema(ctx, schema)
+	if err != nil || schema.DryRun {
+		return plan, err
+	}
+
+	for _, name := range plan.CreateDatabases {
+		err := s.RunContext(ctx, DbCreate(name)).ExecContext(ctx)
+		if err != nil && !IsDatabaseExists(err) {
+			return plan, err
+		}
+	}
+	for _, table := range plan.CreateTables {
+		db := Db(table.Database)
+		err := s.RunContext(ctx, db.TableCreateSpec(table.Spec)).ExecContext(ctx)
+		if err != nil && !IsTableExists(err) {
+			return plan, err
+		}
+	}
+	return plan, nil
+}
+
+// planSchema compares a schema with the server
+func (s *Session) planSchema(ctx context.Context, schema Schema) (*SchemaPlan, error) {
+	plan := &SchemaPlan{}
+
+	databases, err := s.list(ctx, DbList())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, database := range schema.Databases {
+		var tables map[string]bool
+		if databases[database.Name] {
+			tables, err = s.list(ctx, Db(database.Name).TableList())
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			plan.CreateDatabases = append(plan.CreateDatabases, database.Name)
+		}
+
+		wanted := map[string]bool{}
+		for _, spec := range database.Tables {
+			wanted[spec.Name] = true
+			if !tables[spec.Name] {
+				plan.CreateTables = append(plan.CreateTables, SchemaTable{Database: database.Name, Spec: spec})
+			}
+		}
+		for _, name := range sortedNames(tables) {
+			if !wanted[name] {
+				plan.ExtraTables = append(plan.ExtraTables, SchemaTable{Database: database.Name, Spec: TableSpec{Name: name}})
+			}
+		}
+	}
+	return plan, nil
+}
+
+// list runs a .DbList() or .TableList() query
+func (s *Session) list(ctx context.Context, query MetaQuery) (map[string]bool, error) {
+	var names []string
+	if err := s.RunContext(ctx, query).CollectContext(ctx, &names); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, name := range names {
+		set[name] = true
+	}
+	return set, nil
+}
+
+func sortedNames(set map[string]bool) []string {
+	var names []string
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -2,7 +2,8 @@ package rethinkgo
 
 import (
 	"code.google.com/p/goprotobuf/proto"
-	"errors"
+	"context"
+	"crypto/tls"
 	"fmt"
 	p "github.com/christopherhesse/rethinkgo/query_language"
 	"io"
@@ -12,10 +13,6 @@ import (
 	"time"
 )
 
-// maximum number of connections to a server to keep laying around, should add
-// a function to change this if there is any demand
-var maxIdleConnections int = 5
-
 // Session represents a connection to a server, use it to run queries against a
 // database, with either sess.Run(query) or query.Run(session).  It is safe to
 // use from multiple goroutines.
@@ -23,25 +20,62 @@ type Session struct {
 	// current query identifier, just needs to be unique for each query, so we
 	// can match queries with responses, e.g. 4782371
 	token int64
-	// address of server, e.g. "localhost:28015"
-	address string
+	// servers to connect to, e.g. "localhost:28015"
+	hosts *hostList
 	// database to use if no database is specified in query, e.g. "test"
 	database string
 	// maximum duration of a single query
 	timeout time.Duration
-
-	// protects idleConns and closed, because this lock is here, the session
-	// should not be copied according to the "sync" module
+	// how to connect to the server
+	opts ConnectOpts
+	// when to run a query again after a network error
+	retryPolicy RetryPolicy
+	// default options for read queries
+	runOpts RunOpts
+	// fail to decode rows with attributes that don't match a struct field
+	strictDecoding bool
+	// fail writes that report errors, see SetStrictWrites()
+	strictWrites bool
+	// replaces the driver's decoding of rows, see SetDecodeFunc()
+	decodeFunc DecodeFunc
+	// told about every query, see SetQueryHook()
+	hook QueryHook
+
+	// protects the fields below, because this lock is here, the session should
+	// not be copied according to the "sync" module
 	mutex     sync.Mutex
 	idleConns []*connection
 	closed    bool
+
+	// if pipelining is enabled, all queries share sharedConn instead of taking
+	// a connection out of idleConns
+	pipelining bool
+	sharedConn *connection
+	// closed once a query that's connecting sharedConn is done, so that other
+	// queries can wait for it without holding mutex
+	sharedDialing chan struct{}
+
+	// connection pool settings and bookkeeping, see pool.go
+	pool         PoolConfig
+	numOpen      int
+	numDialing   int
+	connWaiters  []chan struct{}
+	waitCount    int64
+	waitDuration time.Duration
+	stopCleaner  chan struct{}
+
+	// Rows iterators that hold a connection, and the leak detector that checks
+	// them, see leak.go
+	streams       map[*streamState]bool
+	leakDetector  *LeakDetector
+	stopLeakCheck chan struct{}
 }
 
 // Query is the interface for queries that can be .Run(session), this includes
 // Exp (run as a read query), MetaQuery, and WriteQuery. Methods that
 // generate a query are generally located on Exp objects.
 type Query interface {
-	toProtobuf(context) *p.Query // will panic on errors
+	toProtobuf(buildContext) *p.Query // will panic on errors
 	Check(*Session) error
 	Run(*Session) *Rows
 }
@@ -52,7 +86,86 @@ type Query interface {
 //
 //  sess, err := r.Connect("localhost:28015", "test")
 func Connect(address, database string) (*Session, error) {
-	s := &Session{address: address, database: database, closed: true}
+	return ConnectWithPool(address, database, PoolConfig{})
+}
+
+// ConnectWithPool creates a new database session, using the given settings for
+// the session's pool of connections.  See PoolConfig for the available
+// settings.
+//
+// Example usage:
+//
+//  pool := r.PoolConfig{MaxOpen: 20, IdleTimeout: time.Minute}
+//  sess, err := r.ConnectWithPool("localhost:28015", "test", pool)
+func ConnectWithPool(address, database string, pool PoolConfig) (*Session, error) {
+	return ConnectWithOpts(ConnectOpts{Address: address, Database: database, Pool: pool})
+}
+
+// ConnectOpts specifies how a session connects to the server, see
+// ConnectWithOpts().
+type ConnectOpts struct {
+	// Address of the server, e.g. "localhost:28015"
+	Address string
+	// Addresses of more servers in the same cluster, see ConnectCluster()
+	Addresses []string
+	// Database to use if no database is specified in a query, e.g. "test"
+	Database string
+	// DialTimeout limits the time taken to connect to the server, including
+	// the TLS handshake.  Zero means no timeout.
+	DialTimeout time.Duration
+	// KeepAlive is the interval between TCP keepalive probes.  Zero means the
+	// operating system default is used, a negative value disables keepalives.
+	// Not used with a custom Dial function.
+	KeepAlive time.Duration
+	// TLSConfig, if set, causes connections to be made using TLS.  If
+	// ServerName is empty, the host part of Address is used.
+	TLSConfig *tls.Config
+	// Dial, if set, is used to open connections instead of dialing TCP, for
+	// instance to go through an SSH tunnel, or to use a unix socket.  It is
+	// called with network "tcp" and the address of the server.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Pool configures the session's connection pool
+	Pool PoolConfig
+	// Collector, if set, receives measurements of the session's queries,
+	// connections and streams, see Collector
+	Collector Collector
+}
+
+// ConnectWithOpts creates a new database session using the given options.
+//
+// Example usage:
+//
+//  sess, err := r.ConnectWithOpts(r.ConnectOpts{
+//      Address:     "db.example.com:28015",
+//      Database:    "test",
+//      DialTimeout: 5 * time.Second,
+//      TLSConfig:   &tls.Config{},
+//  })
+//
+// Example with a unix socket:
+//
+//  dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+//      var d net.Dialer
+//      return d.DialContext(ctx, "unix", "/var/run/rethinkdb.sock")
+//  }
+//  sess, err := r.ConnectWithOpts(r.ConnectOpts{Database: "test", Dial: dial})
+func ConnectWithOpts(opts ConnectOpts) (*Session, error) {
+	addresses := opts.Addresses
+	if opts.Address != "" {
+		addresses = append([]string{opts.Address}, addresses...)
+	}
+	if len(addresses) == 0 && opts.Dial != nil {
+		// the dial function knows where to go
+		addresses = []string{""}
+	}
+
+	s := &Session{
+		hosts:    newHostList(addresses),
+		database: opts.Database,
+		pool:     opts.Pool,
+		opts:     opts,
+		closed:   true,
+	}
 
 	err := s.Reconnect()
 
@@ -63,7 +176,8 @@ func Connect(address, database string) (*Session, error) {
 	return s, nil
 }
 
-// Reconnect closes and re-opens a session.
+// Reconnect closes and re-opens a session.  If the server can't be reached,
+// the session is left closed.
 //
 // Example usage:
 //
@@ -75,12 +189,16 @@ func (s *Session) Reconnect() error {
 
 	s.mutex.Lock()
 	s.closed = false
+	s.startCleaner()
+	s.startLeakCheck()
 	s.mutex.Unlock()
 
 	// create a connection to make sure the server works, then immediately put it
 	// in the idle connection pool
-	conn, err := s.getConn()
+	conn, err := s.getConn(context.Background())
 	if err != nil {
+		// stop anything that was started for the session
+		s.Close()
 		return err
 	}
 
@@ -104,14 +222,36 @@ func (s *Session) Close() error {
 
 	var lastError error
 	for _, conn := range s.idleConns {
-		err := conn.Close()
+		err := s.closeConnLocked(conn)
 		if err != nil {
 			lastError = err
 		}
 	}
 	s.idleConns = nil
+	if s.sharedConn != nil {
+		// any queries still running on this connection will get an error
+		if err := s.closeConnLocked(s.sharedConn); err != nil {
+			lastError = err
+		}
+		s.sharedConn = nil
+	}
 	s.closed = true
 
+	if s.stopCleaner != nil {
+		close(s.stopCleaner)
+		s.stopCleaner = nil
+	}
+	if s.stopLeakCheck != nil {
+		close(s.stopLeakCheck)
+		s.stopLeakCheck = nil
+	}
+	// wake up any queries waiting for a connection, they will see that the
+	// session is closed
+	for _, waiter := range s.connWaiters {
+		close(waiter)
+	}
+	s.connWaiters = nil
+
 	return lastError
 }
 
@@ -129,43 +269,23 @@ func (s *Session) SetTimeout(timeout time.Duration) {
 	s.timeout = timeout
 }
 
-// return a connection from the free connections list if available, otherwise,
-// create a new connection
-func (s *Session) getConn() (*connection, error) {
+// SetPipelining causes future queries run on this session to share a single
+// connection to the server instead of taking a connection each from the pool.
+// Responses are matched up with their queries as they arrive, so many
+// goroutines can run queries at once without each opening a new connection.
+// Rows iterators for streams keep using the shared connection to fetch the
+// rest of their results.
+//
+// With pipelining, a query that times out does not close the connection, since
+// other queries may be using it, any late response for it is discarded.
+//
+// Example usage:
+//
+//  sess.SetPipelining(true)
+func (s *Session) SetPipelining(enabled bool) {
 	s.mutex.Lock()
-	if s.closed {
-		s.mutex.Unlock()
-		return nil, errors.New("rethinkdb: session is closed")
-	}
-	if n := len(s.idleConns); n > 0 {
-		// grab from end of slice so that underlying array does not need to be
-		// resized when appending idle connections later
-		conn := s.idleConns[n-1]
-		s.idleConns = s.idleConns[:n-1]
-		s.mutex.Unlock()
-		return conn, nil
-	}
+	s.pipelining = enabled
 	s.mutex.Unlock()
-
-	conn, err := serverConnect(s.address)
-	if err != nil {
-		return nil, err
-	}
-
-	return conn, nil
-}
-
-// return a connection to the free list, or close it if we already have enough
-func (s *Session) putConn(conn *connection) {
-	s.mutex.Lock()
-	if len(s.idleConns) < maxIdleConnections {
-		s.idleConns = append(s.idleConns, conn)
-		s.mutex.Unlock()
-		return
-	}
-	s.mutex.Unlock()
-
-	conn.Close()
 }
 
 // Use changes the default database for a connection.  This is the database that
@@ -202,33 +322,150 @@ func (s *Session) getToken() int64 {
 //      ...
 //  }
 func (s *Session) Run(query Query) *Rows {
-	queryProto, err := s.getContext().buildProtobuf(query)
+	return s.RunContext(context.Background(), query)
+}
+
+// RunContext is like Run, but gives up waiting for the server once ctx is
+// done, returning an iterator whose .Err() is ctx.Err().  The context also
+// covers connecting to the server, if no idle connection is available, and
+// any further requests the iterator makes with .Next(), .Collect(), etc.  If
+// ctx is done while a stream of results is still open on the server, the
+// stream is stopped, as if .Close() had been called.
+//
+// Example usage:
+//
+//  ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//  defer cancel()
+//  var heroes []interface{}
+//  err := session.RunContext(ctx, r.Table("heroes")).Collect(&heroes)
+func (s *Session) RunContext(ctx context.Context, query Query) *Rows {
+	return s.runWithOpts(ctx, query, RunOpts{})
+}
+
+// RunOpts are options for running a read query, see Exp.RunOpts().  Zero
+// values mean the session's defaults are used, see Session.SetRunOpts().
+type RunOpts struct {
+	// ChunkSize is the maximum number of rows the server sends at a time when
+	// streaming results, more rows mean fewer round trips to the server, fewer
+	// rows mean the first rows arrive sooner.  A negative value asks for all
+	// rows at once.  Zero means the server's default is used.
+	ChunkSize int
+	// MaxAge is passed to the server with the query as a number of seconds.
+	MaxAge time.Duration
+	// Prefetch is the number of chunks of a stream to get from the server in
+	// the background, while earlier rows are still being processed.  Zero
+	// means each chunk is only requested once the previous one has been used
+	// up.  An iterator that prefetches must be closed if it isn't read to the
+	// end, otherwise the goroutine fetching chunks and its connection are only
+	// released once the context the query was run with is done.
+	Prefetch int
+}
+
+// merge fills in the options not set in opts from defaults
+func (opts RunOpts) merge(defaults RunOpts) RunOpts {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = defaults.ChunkSize
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = defaults.MaxAge
+	}
+	if opts.Prefetch == 0 {
+		opts.Prefetch = defaults.Prefetch
+	}
+	return opts
+}
+
+// SetRunOpts sets the default options for read queries run on this session,
+// individual queries can override them with Exp.RunOpts().
+//
+// Example usage:
+//
+//  sess.SetRunOpts(r.RunOpts{ChunkSize: 100})
+func (s *Session) SetRunOpts(opts RunOpts) {
+	s.runOpts = opts
+}
+
+// RunOpts runs a read query with the given options, any options left unset
+// use the session's defaults.
+//
+// Example usage:
+//
+//  // export a large table with fewer round trips to the server
+//  rows := r.Table("events").RunOpts(session, r.RunOpts{ChunkSize: 5000})
+//
+//  // get the next 2 chunks while the current one is being processed
+//  rows := r.Table("events").RunOpts(session, r.RunOpts{Prefetch: 2})
+//  defer rows.Close()
+func (e Exp) RunOpts(session *Session, opts RunOpts) *Rows {
+	return session.runWithOpts(context.Background(), e, opts)
+}
+
+func (s *Session) runWithOpts(ctx context.Context, query Query, opts RunOpts) *Rows {
+	opts = opts.merge(s.runOpts)
+	buildContext := s.getBuildContext()
+	buildContext.runOpts = opts
+	queryProto, err := buildContext.buildProtobuf(query)
 	if err != nil {
 		return &Rows{lasterr: err}
 	}
 
-	queryProto.Token = proto.Int64(s.getToken())
+	policy := s.retryPolicy
+	for attempt := 1; ; attempt++ {
+		// each attempt gets a new token, so that a late response to an earlier
+		// attempt can't be mistaken for the response to this one
+		queryProto.Token = proto.Int64(s.getToken())
+
+		rows, sent := s.runProtobuf(ctx, queryProto, query)
+		if !policy.shouldRetry(attempt, query, sent, rows.Err()) {
+			// keep the query, so that errors can point at the part that failed
+			rows.query, rows.buildContext = query, buildContext
+			rows.lasterr = buildContext.locateError(query, rows.lasterr)
+			if opts.Prefetch > 0 && rows.conn != nil && !rows.complete {
+				rows.startPrefetch(opts.Prefetch)
+			}
+			return rows
+		}
+		if err := policy.wait(ctx, attempt); err != nil {
+			return &Rows{lasterr: err}
+		}
+	}
+}
+
+// runProtobuf runs a query that has already been converted to a protocol
+// buffer, sent reports whether the query may have reached the server.
+func (s *Session) runProtobuf(ctx context.Context, queryProto *p.Query, query Query) (rows *Rows, sent bool) {
+	if err := ctx.Err(); err != nil {
+		return &Rows{lasterr: err}, false
+	}
 
-	conn, err := s.getConn()
+	conn, err := s.getConn(ctx)
 	if err != nil {
-		return &Rows{lasterr: err}
+		return &Rows{lasterr: err}, false
 	}
+	sent = true
 
-	buffer, status, err := conn.executeQuery(queryProto, s.timeout)
+	buffer, status, err := s.execute(ctx, conn, queryProto, query)
 	if err != nil {
 		// see if we got a timeout error, close the connection if we did, since
 		// the connection may not be idle for quite some time and we don't
-		// want to try multiplexing queries over a rethinkdb connection
+		// want to try multiplexing queries over a rethinkdb connection.  The same
+		// goes for a cancelled context.
 		//
 		// judging from rethinkdb's CPU usage, this won't actually terminate the
 		// query, see https://github.com/rethinkdb/rethinkdb/issues/372
-		netErr, ok := err.(net.Error)
-		if ok && netErr.Timeout() {
-			conn.Close()
+		//
+		// a multiplexed connection is left open, the late response is discarded
+		// when it arrives
+		//
+		// after a network error the connection is no good either, and the server
+		// may be down
+		s.hostFailed(conn, err)
+		if abandoned(ctx, err) || isNetworkError(err) {
+			s.discardConn(conn)
 		} else {
 			s.putConn(conn)
 		}
-		return &Rows{lasterr: err}
+		return &Rows{lasterr: err}, sent
 	}
 
 	if status != p.Response_SUCCESS_PARTIAL {
@@ -243,44 +480,50 @@ func (s *Session) Run(query Query) *Rows {
 		// single document (or json) response, return an iterator anyway for
 		// consistency of types
 		return &Rows{
+			session:  s,
 			buffer:   buffer,
 			complete: true,
 			status:   status,
-		}
+		}, sent
 	case p.Response_SUCCESS_PARTIAL:
 		// beginning of stream of rows, there are more results available from the
 		// server than the ones we just received, so save the connection we used in
 		// case the user wants more
-		return &Rows{
+		rows := &Rows{
 			session:  s,
 			conn:     conn,
+			ctx:      ctx,
 			buffer:   buffer,
 			complete: false,
 			token:    queryProto.GetToken(),
 			status:   status,
 		}
+		rows.openStream(query)
+		return rows, sent
 	case p.Response_SUCCESS_STREAM:
 		// end of a stream of rows, since we got this on the initial query this means
 		// that we got a stream response, but the number of results was less than the
 		// number required to break the response into chunks. we can just return all
 		// the results in one go, as this is the only response
 		return &Rows{
+			session:  s,
 			buffer:   buffer,
 			complete: true,
 			status:   status,
-		}
+		}, sent
 	case p.Response_SUCCESS_EMPTY:
 		return &Rows{
+			session:  s,
 			lasterr:  io.EOF,
 			complete: true,
 			status:   status,
-		}
+		}, sent
 	}
-	return &Rows{lasterr: fmt.Errorf("rethinkdb: Unexpected status code from server: %v", status)}
+	return &Rows{lasterr: fmt.Errorf("rethinkdb: Unexpected status code from server: %v", status)}, sent
 }
 
-func (s *Session) getContext() context {
-	return context{databaseName: s.database}
+func (s *Session) getBuildContext() buildContext {
+	return buildContext{databaseName: s.database}
 }
 
 // Run runs a query using the given session, there is one Run()
@@ -0,0 +1,141 @@
+package rethinkgo
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"reflect"
+)
+
+// RawRow is a row sent by Rows.Chan(), JSON is the row as it was sent by the
+// server.  If getting the rows failed, the last RawRow has a nil JSON and the
+// error in Err.
+type RawRow struct {
+	JSON []byte
+	Err  error
+
+	session *Session
+}
+
+// Decode decodes the row into dest, the same way as rows.Next(&dest).
+func (row RawRow) Decode(dest interface{}) error {
+	if row.Err != nil {
+		return row.Err
+	}
+	return row.session.decode(row.JSON, dest)
+}
+
+// Chan sends the rows of a query on a channel from a new goroutine, the channel
+// is closed once all rows have been sent, or an error has been sent, or ctx is
+// done.  The iterator is closed when the goroutine exits, so cancel ctx to stop
+// early, which also stops the stream on the server.  The iterator must not be
+// used in any other way after calling Chan.
+//
+// Example usage:
+//
+//  ctx, cancel := context.WithCancel(context.Background())
+//  defer cancel()
+//  for row := range r.Table("heroes").Run(session).Chan(ctx) {
+//      var hero Hero
+//      if err := row.Decode(&hero); err != nil {
+//          return err
+//      }
+//      fmt.Println("hero:", hero.Name)
+//  }
+func (rows *Rows) Chan(ctx context.Context) <-chan RawRow {
+	ch := make(chan RawRow)
+	go func() {
+		defer close(ch)
+		defer rows.Close()
+
+		for rows.advance(ctx) {
+			select {
+			case ch <- RawRow{JSON: []byte(*rows.current), session: rows.session}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// the receiver may have stopped reading, in which case it's expected to
+		// cancel ctx
+		if err := rows.Err(); err != nil && ctx.Err() == nil {
+			select {
+			case ch <- RawRow{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return ch
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// ForEach calls fn with each row of a query, fn must be a function taking a
+// single argument, of the type that rows should be decoded into, and returning
+// an error.  If fn returns an error, ForEach closes the iterator, stopping the
+// stream on the server, and returns the error.
+//
+// Example usage:
+//
+//  err := r.Table("heroes").Run(session).ForEach(func(hero Hero) error {
+//      if hero.Name == "Superman" {
+//          return errFound // stop early
+//      }
+//      fmt.Println("hero:", hero.Name)
+//      return nil
+//  })
+func (rows *Rows) ForEach(fn interface{}) error {
+	defer rows.Close()
+
+	fnValue := reflect.ValueOf(fn)
+	if !fnValue.IsValid() || fnValue.Kind() != reflect.Func || fnValue.IsNil() {
+		return errors.New("rethinkdb: ForEach needs a function like func(row T) error")
+	}
+	fnType := fnValue.Type()
+	if fnType.NumIn() != 1 || fnType.NumOut() != 1 || fnType.Out(0) != errorType {
+		return errors.New("rethinkdb: ForEach needs a function like func(row T) error")
+	}
+
+	for {
+		dest := reflect.New(fnType.In(0))
+		if !rows.Next(dest.Interface()) {
+			return rows.Err()
+		}
+		result := fnValue.Call([]reflect.Value{dest.Elem()})[0]
+		if !result.IsNil() {
+			return result.Interface().(error)
+		}
+	}
+}
+
+// Stream returns an iterator over the rows of a query, decoded into values of
+// type T, for use with range.  If getting or decoding a row fails, the error is
+// the last value produced.  The Rows iterator is closed once the loop is done,
+// including if it stops early.
+//
+// Example usage:
+//
+//  for hero, err := range r.Stream[Hero](r.Table("heroes").Run(session)) {
+//      if err != nil {
+//          return err
+//      }
+//      fmt.Println("hero:", hero.Name)
+//  }
+func Stream[T any](rows *Rows) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		defer rows.Close()
+
+		for {
+			var row T
+			if !rows.Next(&row) {
+				if err := rows.Err(); err != nil {
+					yield(row, err)
+				}
+				return
+			}
+			if !yield(row, nil) {
+				return
+			}
+		}
+	}
+}
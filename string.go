@@ -159,6 +159,9 @@ func (q WriteQuery) String() string {
 	if q.overwrite {
 		s += ".Overwrite(true)"
 	}
+	if q.idempotent {
+		s += ".Idempotent(true)"
+	}
 	return s
 }
 
@@ -0,0 +1,85 @@
+package rethinkgo
+
+import (
+	"context"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+)
+
+// CollectAs runs a query and returns all of its results as a slice of T, like
+// .Run(session).Collect(&slice).  A query that doesn't return a list of
+// results gives ErrWrongResponseType.
+//
+// Example usage:
+//
+//  heroes, err := r.CollectAs[Hero](r.Table("heroes"), session)
+func CollectAs[T any](query Query, session *Session) ([]T, error) {
+	return CollectAsContext[T](context.Background(), query, session)
+}
+
+// CollectAsContext is like CollectAs, but gives up once ctx is done, returning
+// ctx.Err().
+func CollectAsContext[T any](ctx context.Context, query Query, session *Session) ([]T, error) {
+	rows := session.RunContext(ctx, query)
+	defer rows.Close()
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	if rows.status != p.Response_SUCCESS_PARTIAL && rows.status != p.Response_SUCCESS_STREAM {
+		return nil, ErrWrongResponseType{response: statusResponse(rows.status, rows.token)}
+	}
+
+	results := []T{}
+	for {
+		var row T
+		if !rows.NextContext(ctx, &row) {
+			break
+		}
+		results = append(results, row)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return results, nil
+}
+
+// OneAs runs a query that returns a single result and returns it as a T, like
+// .Run(session).One(&result).
+//
+// Example usage:
+//
+//  hero, err := r.OneAs[Hero](r.Table("heroes").GetById(id), session)
+func OneAs[T any](query Query, session *Session) (T, error) {
+	return OneAsContext[T](context.Background(), query, session)
+}
+
+// OneAsContext is like OneAs, but returns ctx.Err() if ctx is done.
+func OneAsContext[T any](ctx context.Context, query Query, session *Session) (T, error) {
+	rows := session.RunContext(ctx, query)
+	// One() leaves a stream open if it's the wrong type of response
+	defer rows.Close()
+
+	var result T
+	if err := rows.OneContext(ctx, &result); err != nil {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
+
+// RunWrite runs a write query and returns the server's response, like
+// .Run(session).One(&response).
+//
+// Example usage:
+//
+//  response, err := r.RunWrite(r.Table("heroes").Insert(r.Map{"name": "Thing"}), session)
+//  fmt.Println("inserted", response.Inserted, "rows")
+func RunWrite(query WriteQuery, session *Session) (WriteResponse, error) {
+	return RunWriteContext(context.Background(), query, session)
+}
+
+// RunWriteContext is like RunWrite, but returns ctx.Err() if ctx is done.
+func RunWriteContext(ctx context.Context, query WriteQuery, session *Session) (WriteResponse, error) {
+	return OneAsContext[WriteResponse](ctx, query, session)
+}
@@ -0,0 +1,187 @@
+package rethinkgo
+
+import (
+	"context"
+	"fmt"
+	p "github.com/christopherhesse/rethinkgo/query_language"
+	"iter"
+	"reflect"
+)
+
+// TableOf is a table whose rows are stored as values of type T, usually a
+// struct, see TypedTable().  Like Db(db).Table(name), it only names the table,
+// the session is passed to each method that runs a query.
+type TableOf[T any] struct {
+	database   database
+	name       string
+	primaryKey string
+}
+
+// TypedTable returns a handle for reading and writing rows of type T in the
+// table called name in database db, an empty db means the session's database.
+// The table's primary key is the attribute of the struct field tagged
+// "primarykey", or "id" if there is no such field.
+//
+// Example usage:
+//
+//  type Hero struct {
+//      Name     string `rethinkdb:"name,primarykey"`
+//      Strength int    `rethinkdb:"strength"`
+//  }
+//
+//  heroes := r.TypedTable[Hero]("marvel", "heroes")
+//  err := heroes.Create(session)
+//  response, err := heroes.Insert(session, Hero{Name: "Superman", Strength: 10})
+//  superman, err := heroes.Get(session, "Superman")
+func TypedTable[T any](db, name string) *TableOf[T] {
+	primaryKey := "id"
+	if f := primaryKeyField(reflect.TypeOf((*T)(nil)).Elem()); f != nil {
+		primaryKey = f.name
+	}
+	return &TableOf[T]{database: Db(db), name: name, primaryKey: primaryKey}
+}
+
+// primaryKeyField finds the field of a struct type tagged "primarykey", or
+// named "id", returning nil if there is neither
+func primaryKeyField(t reflect.Type) *field {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := cachedFields(t)
+	for i := range fields {
+		if fields[i].primaryKey {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if fields[i].name == "id" {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// PrimaryKey returns the name of the table's primary key attribute.
+func (t *TableOf[T]) PrimaryKey() string {
+	return t.primaryKey
+}
+
+// Table returns the table as an expression, for building other queries.
+//
+// Example usage:
+//
+//  var count int
+//  err := heroes.Table().Count().Run(session).One(&count)
+func (t *TableOf[T]) Table() Exp {
+	return t.database.Table(t.name)
+}
+
+// Create creates the table, using the primary key of T.
+func (t *TableOf[T]) Create(session *Session) error {
+	spec := TableSpec{Name: t.name, PrimaryKey: t.primaryKey}
+	return t.database.TableCreateSpec(spec).Run(session).Exec()
+}
+
+// Get returns the row with the given primary key, or ErrNoSuchRow if there
+// isn't one.
+func (t *TableOf[T]) Get(session *Session, key interface{}) (T, error) {
+	row, err := OneAs[*T](t.Table().Get(key, t.primaryKey), session)
+	if err == nil && row == nil {
+		// the server sends null for a missing row
+		err = ErrNoSuchRow{response: statusResponse(p.Response_SUCCESS_JSON, 0)}
+	}
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return *row, nil
+}
+
+// Insert inserts rows into the table, see Exp.Insert().
+func (t *TableOf[T]) Insert(session *Session, rows ...T) (WriteResponse, error) {
+	list := make([]interface{}, len(rows))
+	for i, row := range rows {
+		list[i] = row
+	}
+	return RunWrite(t.Table().Insert(list...), session)
+}
+
+// Update changes the row with the given primary key, patch can be anything
+// accepted by Exp.Update(), for instance a struct with only some fields set,
+// tagged "omitempty".
+//
+// Example usage:
+//
+//  response, err := heroes.Update(session, "Superman", r.Map{"strength": 11})
+func (t *TableOf[T]) Update(session *Session, key interface{}, patch interface{}) (WriteResponse, error) {
+	return RunWrite(t.Table().Get(key, t.primaryKey).Update(patch), session)
+}
+
+// Replace replaces the row with the same primary key as row.
+func (t *TableOf[T]) Replace(session *Session, row T) (WriteResponse, error) {
+	key, err := t.keyOf(row)
+	if err != nil {
+		return WriteResponse{}, err
+	}
+	return RunWrite(t.Table().Get(key, t.primaryKey).Replace(row), session)
+}
+
+// keyOf returns the value of the primary key field of a row
+func (t *TableOf[T]) keyOf(row T) (interface{}, error) {
+	rowValue := reflect.ValueOf(&row).Elem()
+	f := primaryKeyField(rowValue.Type())
+	if f == nil {
+		return nil, fmt.Errorf("rethinkdb: %v has no primary key field", rowValue.Type())
+	}
+	if rowValue.Kind() == reflect.Ptr {
+		if rowValue.IsNil() {
+			return nil, fmt.Errorf("rethinkdb: Cannot replace a nil %v", rowValue.Type())
+		}
+		rowValue = rowValue.Elem()
+	}
+	key, ok := fieldByIndexNoAlloc(rowValue, f.index)
+	if !ok {
+		return nil, fmt.Errorf("rethinkdb: %v has no primary key value", rowValue.Type())
+	}
+	return key.Interface(), nil
+}
+
+// Delete deletes the row with the given primary key.
+func (t *TableOf[T]) Delete(session *Session, key interface{}) (WriteResponse, error) {
+	return RunWrite(t.Table().Get(key, t.primaryKey).Delete(), session)
+}
+
+// Filter returns the rows matching predicate, which can be anything accepted by
+// Exp.Filter().
+//
+// Example usage:
+//
+//  strong, err := heroes.Filter(session, r.Row.Attr("strength").Gt(5))
+func (t *TableOf[T]) Filter(session *Session, predicate interface{}) ([]T, error) {
+	return CollectAs[T](t.Table().Filter(predicate), session)
+}
+
+// All returns an iterator over all rows of the table, for use with range, see
+// Stream().  The query is run when the loop starts.
+//
+// Example usage:
+//
+//  for hero, err := range heroes.All(ctx, session) {
+//      if err != nil {
+//          return err
+//      }
+//      fmt.Println("hero:", hero.Name)
+//  }
+func (t *TableOf[T]) All(ctx context.Context, session *Session) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for row, err := range Stream[T](session.RunContext(ctx, t.Table())) {
+			if !yield(row, err) {
+				return
+			}
+		}
+	}
+}